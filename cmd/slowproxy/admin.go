@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/dmiruke/slowproxy/internal/admin"
+)
+
+// adminProxy is the proxy as controlled through the admin API, which records the changes in audit, which may be nil.
+type adminProxy struct {
+	px    *proxy
+	audit *auditLog
+}
+
+// serveAdmin serves the admin API on listener, see package admin.
+func (px *proxy) serveAdmin(listener net.Listener, audit *auditLog) {
+	if err := admin.Serve(listener, adminProxy{px: px, audit: audit}, parseThroughput); err != nil {
+		log.Printf("admin: %v", err)
+	}
+}
+
+func (a adminProxy) Conditions() admin.Conditions {
+	live := &a.px.cfg.live
+	up, down := live.currentThroughput()
+	latency, jitter := live.currentLatency()
+	return admin.Conditions{Up: up, Down: down, Latency: latency.String(), Jitter: jitter.String(),
+		Paused: live.isPaused()}
+}
+
+func (a adminProxy) Connections() []admin.Connection {
+	var conns []admin.Connection
+	for _, c := range a.px.conns.open() {
+		conns = append(conns, admin.Connection{ID: c.id, Client: c.name, Upstream: c.up.wName, Label: c.getLabel(),
+			Opened: c.opened, Up: c.up.sample().transferred, Down: c.down.sample().transferred,
+			Conditions: c.effective(a.px.cfg)})
+	}
+	return conns
+}
+
+// Change applies change to the live conditions and records what changed in the audit log.
+func (a adminProxy) Change(who string, change admin.Change) {
+	live := &a.px.cfg.live
+	previousUp, previousDown := live.currentThroughput()
+	previousLatency, previousJitter := live.currentLatency()
+	up, down := previousUp, previousDown
+	latency, jitter := previousLatency, previousJitter
+	if change.Up != nil {
+		up = *change.Up
+	}
+	if change.Down != nil {
+		down = *change.Down
+	}
+	if change.Latency != nil {
+		latency = *change.Latency
+	}
+	if change.Jitter != nil {
+		jitter = *change.Jitter
+	}
+
+	if up != previousUp || down != previousDown {
+		live.setThroughput(up, down)
+		a.audit.record(who, "admin", "throughput down %d -> %d, up %d -> %d", previousDown, down, previousUp, up)
+	}
+	if latency != previousLatency || jitter != previousJitter {
+		live.setLatency(latency, jitter)
+		a.audit.record(who, "admin", "latency %v -> %v, jitter %v -> %v", previousLatency, latency, previousJitter,
+			jitter)
+	}
+	if change.Paused != nil && live.setPaused(*change.Paused) {
+		if *change.Paused {
+			a.audit.record(who, "admin", "paused")
+		} else {
+			a.audit.record(who, "admin", "resumed")
+		}
+	}
+	a.px.conns.noteConditions(a.px.cfg)
+}
+
+func (a adminProxy) Config() []byte {
+	return a.px.configFile(flag.CommandLine)
+}
+
+// replacedFlags are the options configFile replaces with the current conditions, or leaves out.
+var replacedFlags = map[string]bool{"up": true, "down": true, "latency": true, "jitter": true, "profile": true,
+	"schedule": true, "config": true}
+
+// configFile returns a configuration file for -config that starts a proxy with the current conditions: the options
+// set in fs, from the command line or a configuration file, with the throughput, latency and jitter as changed since.
+// Since they have been applied already, -profile, -schedule and -config are left out. The values of secretFlags are
+// replaced with REDACTED, so they can be filled in without having leaked from the API. Pausing cannot be configured.
+func (px *proxy) configFile(fs *flag.FlagSet) []byte {
+	cfg := px.cfg
+	var out bytes.Buffer
+	setting := func(name, value string) {
+		fmt.Fprintf(&out, "%s: %s\n", name, quoteConfigValue(value))
+	}
+	setting("listen", cfg.listen)
+	if cfg.forwardExec == "" && cfg.forwardBuiltin == "" && !cfg.socks5 {
+		setting("forward", cfg.forward)
+	}
+	up, down := cfg.live.currentThroughput()
+	setting("throughput", strconv.Itoa(max(up, down)))
+	if up != down {
+		setting("up", strconv.Itoa(up))
+		setting("down", strconv.Itoa(down))
+	}
+	latency, jitter := cfg.live.currentLatency()
+	if latency > 0 {
+		setting("latency", latency.String())
+	}
+	if jitter > 0 {
+		setting("jitter", jitter.String())
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch {
+		case replacedFlags[f.Name]:
+		case secretFlags[f.Name]:
+			setting(f.Name, "REDACTED")
+		case repeatable(f):
+			fmt.Fprintf(&out, "%s:\n", f.Name)
+			for _, value := range strings.Split(f.Value.String(), ",") {
+				fmt.Fprintf(&out, "  - %s\n", quoteConfigValue(value))
+			}
+		default:
+			setting(f.Name, f.Value.String())
+		}
+	})
+	return out.Bytes()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("slowproxy", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.Duration("latency", 0, "")
+	fs.String("influx-token", "", "")
+	fs.String("forward-exec", "", "")
+	fs.Int("socket-buffer", -1, "")
+	fs.Var(&routes{}, "tenant", "")
+	for name, value := range map[string]string{"config": "old.yaml", "latency": "10ms", "influx-token": "secret",
+		"forward-exec": "cat # not a comment", "socket-buffer": "-1", "tenant": "a=x:1,b=y:2"} {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config{listen: ":8080", forward: "localhost:80"}
+	cfg.live.setThroughput(1000, 2000)
+	cfg.live.setLatency(40*time.Millisecond, 0)
+
+	path := filepath.Join(t.TempDir(), "tuned.yaml")
+	if err := os.WriteFile(path, newProxy(cfg, nil).configFile(fs), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, s := range settings {
+		got[s.name] = s.values
+	}
+	// the current conditions in place of the options they were started with, and no -config to apply twice
+	want := map[string][]string{
+		"listen": {":8080"}, "forward": {"localhost:80"}, "throughput": {"2000"}, "up": {"1000"}, "down": {"2000"},
+		"latency": {"40ms"}, "influx-token": {"REDACTED"}, "forward-exec": {"cat # not a comment"},
+		"socket-buffer": {"-1"}, "tenant": {"a=x:1", "b=y:2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read back %v, want %v", got, want)
+	}
+}
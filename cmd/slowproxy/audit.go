@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// auditLog records the changes made to a running proxy, so unexpected changes in conditions can be attributed to the
+// operator or script that made them after an experiment. A nil *auditLog records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens (or creates) the audit log at path, appending to it.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// record writes a line with the time, who made the change through source and what changed, eg.
+// "2024-05-01T12:00:00Z user=alice source=interactive throughput 100000 -> 50000". Failing to record is logged but
+// does not undo the change.
+func (a *auditLog) record(who, source, format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := fmt.Fprintf(a.file, "%s user=%s source=%s %s\n", time.Now().UTC().Format(time.RFC3339), who, source,
+		fmt.Sprintf(format, args...))
+	if err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// operator identifies the user running the proxy, who is the one issuing interactive commands.
+func operator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid:%d", os.Getuid())
+}
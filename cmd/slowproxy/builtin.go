@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// newBuiltin creates an endpoint for one of the built-in upstreams, which allow exercising the proxy without deploying
+// a backend:
+//
+//	echo     sends back everything it receives
+//	discard  swallows everything it receives and sends nothing
+//	chargen  sends a never ending character pattern (RFC 864), at chargenRate bytes per second if it is not 0
+func newBuiltin(name string, chargenRate int) (endpoint, error) {
+	switch name {
+	case "echo":
+		pr, pw := io.Pipe()
+		return &echoConn{pr: pr, pw: pw}, nil
+	case "discard":
+		return &discardConn{done: make(chan struct{})}, nil
+	case "chargen":
+		return &chargenConn{rate: chargenRate, done: make(chan struct{})}, nil
+	default:
+		return nil, fmt.Errorf("unknown built-in upstream %s", name)
+	}
+}
+
+// echoConn is the echo built-in upstream.
+type echoConn struct {
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+func (c *echoConn) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+func (c *echoConn) Write(p []byte) (int, error) {
+	return c.pw.Write(p)
+}
+
+// CloseRead stops echoing, further writes fail.
+func (c *echoConn) CloseRead() error {
+	return c.pr.Close()
+}
+
+// CloseWrite ends the echoed stream once everything written so far has been read.
+func (c *echoConn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+func (c *echoConn) Close() error {
+	c.pw.Close()
+	return c.pr.Close()
+}
+
+func (c *echoConn) String() string {
+	return "builtin:echo"
+}
+
+// discardConn is the discard built-in upstream. Reading blocks until the client stops sending, like a discard server
+// closing the connection once the client has.
+type discardConn struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *discardConn) Read(p []byte) (int, error) {
+	<-c.done
+	return 0, io.EOF
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *discardConn) CloseRead() error {
+	return c.Close()
+}
+
+func (c *discardConn) CloseWrite() error {
+	return c.Close()
+}
+
+func (c *discardConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *discardConn) String() string {
+	return "builtin:discard"
+}
+
+// chargenLineLength is the length of a chargen line without the line break.
+const chargenLineLength = 72
+
+// chargenConn is the chargen built-in upstream. It sends lines of 72 printable ASCII characters, each starting one
+// character later than the previous one, and ignores what it receives.
+type chargenConn struct {
+	rate   int // bytes per second, 0 for unlimited
+	offset int // position in the pattern, counted in bytes
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *chargenConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, io.EOF
+	default:
+	}
+
+	n := len(p)
+	if c.rate > 0 {
+		// hand out at most a tenth of a second worth of data at a time to keep the rate smooth
+		n = min(n, max(c.rate/10, 1))
+	}
+	for i := 0; i < n; i++ {
+		p[i] = c.next()
+	}
+	if c.rate > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(c.rate))
+	}
+	return n, nil
+}
+
+// next returns the next byte of the pattern.
+func (c *chargenConn) next() byte {
+	const printable = 95 // the characters from ' ' to '~'
+	line, column := c.offset/(chargenLineLength+2), c.offset%(chargenLineLength+2)
+	c.offset++
+	switch column {
+	case chargenLineLength:
+		return '\r'
+	case chargenLineLength + 1:
+		return '\n'
+	default:
+		return byte(' ' + (line+column)%printable)
+	}
+}
+
+func (c *chargenConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *chargenConn) CloseRead() error {
+	return c.Close()
+}
+
+// CloseWrite does nothing, chargen keeps sending until the connection is closed completely.
+func (c *chargenConn) CloseWrite() error {
+	return nil
+}
+
+func (c *chargenConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *chargenConn) String() string {
+	return "builtin:chargen"
+}
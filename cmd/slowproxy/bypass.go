@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+)
+
+// bypassed determines whether the connection from addr is exempt from the conditions: with -bypass-loopback, local
+// health probes keep working however harsh the conditions for everyone else are.
+func (px *proxy) bypassed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return px.cfg.bypassLoopback && ok && tcpAddr.IP.IsLoopback()
+}
+
+// bypass forwards conn to the upstream at forward, or to the builtin upstream if not empty, without any conditions.
+// Bypassed connections are neither logged nor counted, so frequent probes do not clutter the logs and statistics.
+func (px *proxy) bypass(conn endpoint, forward, builtin string) {
+	if secured, ok := conn.(*tlsConn); ok {
+		if err := secured.handshake(); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	// dialed without connectUpstream, whose socket buffers sized for the throughput would hold the transfer back
+	upstream, _, err := dialForward(px.cfg, forward, px.cfg.upstreamHeader(conn), builtin)
+	if err != nil {
+		px.dialErrors.add(errorClass(err))
+		log.Printf("unable to dial: %v", err)
+		conn.Close()
+		return
+	}
+
+	upstreamDone := make(chan struct{})
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.CloseWrite()
+		close(upstreamDone)
+	}()
+	io.Copy(conn, upstream)
+	conn.CloseWrite()
+	<-upstreamDone
+	conn.Close()
+	upstream.Close()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// positionalSettings are the settings of a configuration file that take the place of the arguments.
+var positionalSettings = []string{"listen", "forward", "throughput"}
+
+// configSetting is a setting of a configuration file with its values, more than one for a list, and the line it
+// starts on for errors.
+type configSetting struct {
+	name   string
+	values []string
+	line   int
+	list   bool // the values are a list or mapping, even if there is only one
+	block  bool // the values are on the indented lines that follow
+}
+
+// readConfigFile reads the settings of the configuration file at path, which is written in a subset of YAML: each
+// setting is a line "name: value" with the name of an option or one of listen, forward and throughput, and comments
+// start with #. Options that can be repeated take a list, either as [a, b] or as indented "- value" lines below
+// "name:", and options of the form NAME=ROUTE, eg. -route and -tenant, also take indented "NAME: ROUTE" lines.
+func readConfigFile(path string) ([]configSetting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings []configSetting
+	first := map[string]int{} // line each setting is on
+	scanner := bufio.NewScanner(f)
+	for number := 1; scanner.Scan(); number++ {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, number, fmt.Sprintf(format, args...))
+		}
+		line, err := stripComment(scanner.Text())
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		content := strings.TrimLeft(line, " \t")
+		if content == "" || content == "---" {
+			continue
+		}
+		indented := len(content) < len(line)
+		if strings.Contains(line[:len(line)-len(content)], "\t") {
+			return nil, fail("indent with spaces, tabs are not allowed")
+		}
+
+		if indented {
+			if len(settings) == 0 || !settings[len(settings)-1].block {
+				return nil, fail("unexpected indentation")
+			}
+			s := &settings[len(settings)-1]
+			if item, ok := strings.CutPrefix(content, "- "); ok {
+				s.values = append(s.values, unquote(strings.TrimSpace(item)))
+			} else if key, value, ok := cutKey(content); ok && value != "" {
+				s.values = append(s.values, unquote(key)+"="+unquote(value))
+			} else {
+				return nil, fail(`expected "- VALUE" or "NAME: VALUE" below %s`, s.name)
+			}
+			continue
+		}
+
+		if len(settings) > 0 && settings[len(settings)-1].block && len(settings[len(settings)-1].values) == 0 {
+			return nil, fail("%s has no value", settings[len(settings)-1].name)
+		}
+		name, value, ok := cutKey(content)
+		if !ok {
+			return nil, fail(`expected "NAME: VALUE", not %q`, content)
+		}
+		name = unquote(name)
+		if line, ok := first[name]; ok {
+			return nil, fail("%s is already set on line %d", name, line)
+		}
+		first[name] = number
+		s := configSetting{name: name, line: number}
+		switch {
+		case value == "":
+			s.list, s.block = true, true
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			s.list = true
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					s.values = append(s.values, unquote(item))
+				}
+			}
+		default:
+			s.values = []string{unquote(value)}
+		}
+		settings = append(settings, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(settings) > 0 && settings[len(settings)-1].block && len(settings[len(settings)-1].values) == 0 {
+		s := settings[len(settings)-1]
+		return nil, fmt.Errorf("%s:%d: %s has no value", path, s.line, s.name)
+	}
+	return settings, nil
+}
+
+// cutKey splits "NAME: VALUE" or "NAME:". The name may contain colons, eg. an address.
+func cutKey(s string) (string, string, bool) {
+	if name, ok := strings.CutSuffix(s, ":"); ok {
+		return strings.TrimSpace(name), "", true
+	}
+	name, value, ok := strings.Cut(s, ": ")
+	return strings.TrimSpace(name), strings.TrimSpace(value), ok && strings.TrimSpace(name) != ""
+}
+
+// stripComment removes a comment from line, which starts with a # at the start of the line or after a space outside
+// quotes.
+func stripComment(line string) (string, error) {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t"), nil
+		}
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated quote")
+	}
+	return strings.TrimRight(line, " \t"), nil
+}
+
+// unquote removes the quotes around s, if any.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// quoteConfigValue quotes value for a configuration file if it would not be read back as it is otherwise.
+func quoteConfigValue(value string) string {
+	plain := value != "" && strings.TrimSpace(value) == value && !strings.HasSuffix(value, ":") &&
+		!strings.ContainsAny(value[:1], `"'[#`) && !strings.Contains(value, " #")
+	if plain {
+		return value
+	}
+	if strings.Contains(value, `"`) {
+		return "'" + value + "'"
+	}
+	return `"` + value + `"`
+}
+
+// configArgs are the arguments given by a configuration file by name, see applyConfigFile.
+type configArgs struct {
+	path  string
+	given map[string]configSetting // by listen, forward and throughput
+}
+
+// arguments returns the arguments given by the file as on the command line: LISTEN, then FORWARD unless
+// withoutForward, as with -forward-exec, -forward-builtin and -socks5, then THROUGHPUT, which may be left out if
+// profiled, as with -profile and -profile-mix. Missing and invalid arguments are reported with the file and line.
+func (a configArgs) arguments(withoutForward, profiled bool) ([]string, error) {
+	listen, ok := a.given["listen"]
+	if !ok {
+		return nil, fmt.Errorf("%s: listen is missing", a.path)
+	}
+	args := []string{listen.values[0]}
+	forward, ok := a.given["forward"]
+	switch {
+	case withoutForward && ok:
+		return nil, fmt.Errorf("%s:%d: forward cannot be used with -forward-exec, -forward-builtin or -socks5", a.path,
+			forward.line)
+	case !withoutForward && !ok:
+		return nil, fmt.Errorf("%s: forward is missing", a.path)
+	case !withoutForward:
+		args = append(args, forward.values[0])
+	}
+	throughput, ok := a.given["throughput"]
+	if !ok {
+		if profiled {
+			return args, nil
+		}
+		return nil, fmt.Errorf("%s: throughput is missing", a.path)
+	}
+	if value, err := parseThroughput(throughput.values[0]); err != nil || value <= 0 {
+		return nil, fmt.Errorf("%s:%d: throughput must be at least 1 byte per second, eg. 512k, not %q", a.path,
+			throughput.line, throughput.values[0])
+	}
+	return append(args, throughput.values[0]), nil
+}
+
+// applyConfigFile sets the options of fs from the configuration file at path that are not in commandLine, as options
+// on the command line take precedence, and returns the arguments it gives.
+func applyConfigFile(fs *flag.FlagSet, path string, commandLine map[string]bool) (configArgs, error) {
+	args := configArgs{path: path, given: map[string]configSetting{}}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return args, err
+	}
+	for _, s := range settings {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, s.line, fmt.Sprintf(format, args...))
+		}
+		if isPositionalSetting(s.name) {
+			if s.list || len(s.values) != 1 {
+				return args, fail("%s takes a single value", s.name)
+			}
+			args.given[s.name] = s
+			continue
+		}
+		f := fs.Lookup(s.name)
+		if f == nil || s.name == "config" {
+			if suggestion := closestOption(fs, s.name); suggestion != "" {
+				return args, fail("unknown setting %s, did you mean %s?", s.name, suggestion)
+			}
+			return args, fail("unknown setting %s", s.name)
+		}
+		if s.list && !repeatable(f) {
+			return args, fail("%s takes a single value, only options that can be repeated take a list", s.name)
+		}
+		if commandLine[s.name] {
+			continue
+		}
+		for _, value := range s.values {
+			if err := fs.Set(s.name, value); err != nil {
+				return args, fail("invalid value %q for %s: %v", value, s.name, err)
+			}
+		}
+	}
+	return args, nil
+}
+
+// repeatable reports whether the option f adds up the values it is given when repeated, so it takes a list.
+func repeatable(f *flag.Flag) bool {
+	switch f.Value.(type) {
+	case *routes, *listenRoutes, *httpRoutes, *profileMix, *listenerSet:
+		return true
+	}
+	return false
+}
+
+func isPositionalSetting(name string) bool {
+	for _, positional := range positionalSettings {
+		if name == positional {
+			return true
+		}
+	}
+	return false
+}
+
+// closestOption returns the option of fs or positional setting name is most likely a misspelling of, if any.
+func closestOption(fs *flag.FlagSet, name string) string {
+	best, bestDistance := "", 3 // suggest names at most two edits away
+	consider := func(candidate string) {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" {
+			consider(f.Name)
+		}
+	})
+	for _, positional := range positionalSettings {
+		consider(positional)
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, substitution)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file with content and returns its path, config.yaml in a new directory.
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkError reports err unless it contains want, or if there is no error for want.
+func checkError(t *testing.T, content string, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("%q: %v", content, err)
+	case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+		t.Errorf("%q: error %v, want %q", content, err, want)
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		file     string
+		settings map[string][]string
+		err      string // part of the error, "" for none
+	}{
+		{"# a comment\nlatency: 40ms # and another\n\n", map[string][]string{"latency": {"40ms"}}, ""},
+		{"---\nforward: app:80\n", map[string][]string{"forward": {"app:80"}}, ""},
+		{"forward-exec: \"cat # not a comment\"\n", map[string][]string{"forward-exec": {"cat # not a comment"}}, ""},
+		{"log-file: 'a b.log'\n", map[string][]string{"log-file": {"a b.log"}}, ""},
+		{"latency:\t40ms\n", nil, `config.yaml:1: expected "NAME: VALUE"`},
+		{"latency: 40ms\t# tabs before comments are fine\n", map[string][]string{"latency": {"40ms"}}, ""},
+		{"tenant:\n\t- a=x:1\n", nil, "config.yaml:2: indent with spaces, tabs are not allowed"},
+		{"latency: 40ms\nlatency: 50ms\n", nil, "config.yaml:2: latency is already set on line 1"},
+		{"log-file: \"unterminated\n", nil, "config.yaml:1: unterminated quote"},
+		{"  latency: 40ms\n", nil, "config.yaml:1: unexpected indentation"},
+		{"tenant:\nlatency: 40ms\n", nil, "config.yaml:2: tenant has no value"},
+		{"tenant:\n", nil, "config.yaml:1: tenant has no value"},
+		{"tenant:\n  - a=x:1\n  b: y:2\n", map[string][]string{"tenant": {"a=x:1", "b=y:2"}}, ""},
+	}
+	for _, test := range tests {
+		settings, err := readConfigFile(writeConfig(t, test.file))
+		checkError(t, test.file, err, test.err)
+		if err != nil || test.err != "" {
+			continue
+		}
+		got := map[string][]string{}
+		for _, s := range settings {
+			got[s.name] = s.values
+		}
+		if !reflect.DeepEqual(got, test.settings) {
+			t.Errorf("%q: settings %v, want %v", test.file, got, test.settings)
+		}
+	}
+}
+
+// testFlags returns a set of options like those of main for applyConfigFile.
+func testFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("slowproxy", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.Var(new(throughputValue), "up", "")
+	fs.Duration("latency", 0, "")
+	fs.Var(&listenRoutes{}, "route", "")
+	return fs
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	tests := []struct {
+		file string
+		err  string // part of the error, "" for none
+	}{
+		{"up: 1k\n", ""},
+		{"up: [1k, 2k]\n", "config.yaml:1: up takes a single value"},
+		{"listen: :1\nup: [1k]\n", "config.yaml:2: up takes a single value"},
+		{"up:\n  - 1k\n", "config.yaml:1: up takes a single value"},
+		{"up:\n  a: b\n", "config.yaml:1: up takes a single value"},
+		{"throughput: [1k, 2k]\n", "config.yaml:1: throughput takes a single value"},
+		{"route: [:1=a:1, :2=a:2]\n", ""},
+		{"route:\n  - :3=a:3\n  :4: a:4\n", ""},
+		{"latency: soon\n", `config.yaml:1: invalid value "soon" for latency`},
+		{"latncy: 40ms\n", "config.yaml:1: unknown setting latncy, did you mean latency?"},
+		{"fowrard: app:80\n", "config.yaml:1: unknown setting fowrard, did you mean forward?"},
+		{"bandwidth: 1M\n", "config.yaml:1: unknown setting bandwidth"},
+		{"config: other.yaml\n", "config.yaml:1: unknown setting config"},
+	}
+	for _, test := range tests {
+		_, err := applyConfigFile(testFlags(), writeConfig(t, test.file), nil)
+		checkError(t, test.file, err, test.err)
+		if err != nil && strings.Contains(err.Error(), "did you mean config") {
+			t.Errorf("%q: suggested -config, which a file cannot set", test.file)
+		}
+	}
+
+	fs := testFlags()
+	if _, err := applyConfigFile(fs, writeConfig(t, "route: [:1=a:1, :2=a:2]\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfigFile(fs, writeConfig(t, "route:\n  - :3=a:3\n  :4: a:4\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if routes := fs.Lookup("route").Value.(*listenRoutes); len(*routes) != 4 {
+		t.Errorf("routes %v, want all 4 from the lists", *routes)
+	}
+}
+
+func TestApplyConfigFilePrecedence(t *testing.T) {
+	fs := testFlags()
+	if err := fs.Parse([]string{"-latency", "10ms"}); err != nil {
+		t.Fatal(err)
+	}
+	commandLine := map[string]bool{"latency": true}
+	if _, err := applyConfigFile(fs, writeConfig(t, "latency: 40ms\nup: 1k\n"), commandLine); err != nil {
+		t.Fatal(err)
+	}
+	if latency := fs.Lookup("latency").Value.String(); latency != "10ms" {
+		t.Errorf("latency %s, want 10ms from the command line", latency)
+	}
+	if up := fs.Lookup("up").Value.String(); up != "1000" {
+		t.Errorf("up %s, want 1000 from the file", up)
+	}
+}
+
+func TestConfigArguments(t *testing.T) {
+	tests := []struct {
+		file                     string
+		withoutForward, profiled bool
+		args                     []string
+		err                      string // part of the error, "" for none
+	}{
+		{"listen: :1\nforward: a:1\nthroughput: 1k\n", false, false, []string{":1", "a:1", "1k"}, ""},
+		{"throughput: 1k\nforward: a:1\nlisten: :1\n", false, false, []string{":1", "a:1", "1k"}, ""},
+		// THROUGHPUT must not take the place of the missing FORWARD
+		{"listen: :1\nthroughput: 1k\n", false, true, nil, "config.yaml: forward is missing"},
+		{"listen: :1\nforward: a:1\n", false, true, []string{":1", "a:1"}, ""},
+		{"listen: :1\nforward: a:1\n", false, false, nil, "config.yaml: throughput is missing"},
+		{"forward: a:1\nthroughput: 1k\n", false, false, nil, "config.yaml: listen is missing"},
+		{"listen: :1\nthroughput: 1k\n", true, false, []string{":1", "1k"}, ""},
+		{"listen: :1\nforward: a:1\nthroughput: 1k\n", true, false, nil,
+			"config.yaml:2: forward cannot be used with -forward-exec"},
+		{"listen: :1\nforward: a:1\nthroughput: fast\n", false, false, nil, "config.yaml:3: throughput must be"},
+		{"listen: :1\nforward: a:1\nthroughput: 0\n", false, false, nil, "config.yaml:3: throughput must be"},
+	}
+	for _, test := range tests {
+		fileArgs, err := applyConfigFile(testFlags(), writeConfig(t, test.file), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := fileArgs.arguments(test.withoutForward, test.profiled)
+		checkError(t, test.file, err, test.err)
+		if test.err == "" && !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: arguments %q, want %q", test.file, args, test.args)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+	"github.com/dmiruke/slowproxy/internal/relay"
+)
+
+// noticeWindow is the period a copy direction has to stay below the throughput cap without being throttled before a
+// NOTICE is logged for it.
+const noticeWindow = 10 * time.Second
+
+// connection is the state shared by both pipes of a proxied connection.
+type connection struct {
+	id               uint64 // assigned by the registry
+	name             string // identifies the client in logs
+	listener         string // the address the client connected to, as given on the command line
+	opened           time.Time
+	client, upstream endpoint
+	up, down         *pipe        // the pipes towards the upstream and towards the client
+	account          *account     // usage of the client's IP address, nil without a ledger
+	overQuota        uint32       // set once exceeding the quota has been logged
+	lastActivity     int64        // time of the last transfer in either direction, see touch
+	stalls           uint32       // number of times the connection was stalled with -idle-stall
+	sampled          bool         // per-connection samples are exported, see config.sampleRate
+	label            atomic.Value // string describing what the connection is for, see httpRequestLabel
+	reason           atomic.Value // string describing why the connection ended, see endedBy
+	profile          *profile     // latency and jitter of the connection's route instead of the global ones, or nil
+	closed           int64        // time the first side closed in Unix nanoseconds, see endedBy
+	lingerWarned     uint32       // set once lingering after the first close has been logged
+
+	mu         sync.Mutex
+	conditions []string // the conditions in effect over the life of the connection, see noteConditions
+	current    string   // the conditions in effect now
+}
+
+// endedBy records why the connection ends, unless an earlier cause has been recorded already. Reasons name the side
+// and the event, eg. client-eof, upstream-reset or upstream-closed when the upstream stopped reading, or the fault
+// that ended the connection, eg. quota or idle-reset. The first call also marks the start of the teardown.
+func (c *connection) endedBy(reason string) {
+	if c.reason.CompareAndSwap(nil, reason) {
+		atomic.StoreInt64(&c.closed, time.Now().UnixNano())
+	}
+}
+
+// firstClosed returns when the first side closed, or the zero time while both are open.
+func (c *connection) firstClosed() time.Time {
+	if closed := atomic.LoadInt64(&c.closed); closed != 0 {
+		return time.Unix(0, closed)
+	}
+	return time.Time{}
+}
+
+// endReason returns why the connection ended, see endedBy.
+func (c *connection) endReason() string {
+	if reason, ok := c.reason.Load().(string); ok {
+		return reason
+	}
+	return "unknown"
+}
+
+// errorReason describes err as a suffix for a reason passed to endedBy.
+func errorReason(err error) string {
+	if errors.Is(err, syscall.ECONNRESET) {
+		return "-reset"
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "-timeout"
+	}
+	return "-error"
+}
+
+// currentThroughput determines the throughput for the pipe, which follows runtime changes unless they only apply to
+// new connections or the pipe's throughput is pinned.
+func (p *pipe) currentThroughput() int {
+	cfg := p.cfg
+	if cfg.applyChanges == "new" || p.pinned {
+		return p.throughput
+	}
+	up, down := cfg.live.currentThroughput()
+	if p.Direction == relay.Up {
+		return up
+	}
+	return down
+}
+
+// getLabel returns the connection's label, or "" if it has none.
+func (c *connection) getLabel() string {
+	label, _ := c.label.Load().(string)
+	return label
+}
+
+// noteConditions records the conditions in effect for the connection if they changed since the last note, so the
+// close report shows everything the connection experienced. It is called when the connection opens and whenever the
+// conditions may have changed.
+func (c *connection) noteConditions(cfg *config) {
+	current := c.effective(cfg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current == c.current {
+		return
+	}
+	if c.conditions == nil {
+		c.conditions = append(c.conditions, current)
+	} else {
+		c.conditions = append(c.conditions, fmt.Sprintf("at +%v: %s", time.Since(c.opened).Round(time.Millisecond),
+			current))
+	}
+	c.current = current
+}
+
+// conditionHistory describes the conditions in effect over the life of the connection, with the time of each change
+// relative to the opening of the connection, eg. "throughput 1000 bytes/s; at +30s: throughput 500 bytes/s".
+func (c *connection) conditionHistory() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.conditions, "; ")
+}
+
+// effective describes the conditions currently applied to the connection, after runtime changes and quotas, eg.
+// "throughput 1000 bytes/s (quota exceeded), close delay 1s, garble downstream 0.1".
+func (c *connection) effective(cfg *config) string {
+	up, down := c.up.currentThroughput(), c.down.currentThroughput()
+	if cfg.overQuota(c.account) {
+		up, down = min(up, cfg.quotaThroughput), min(down, cfg.quotaThroughput)
+	}
+	conditions := []string{"throughput " + formatThroughput(up, down)}
+	if c.profile != nil {
+		conditions[0] += " (profile " + c.profile.name + ")"
+	}
+	if cfg.shared {
+		conditions[0] += " shared"
+	}
+	if cfg.overQuota(c.account) {
+		conditions[0] += " (quota exceeded)"
+	}
+	if cfg.live.isPaused() {
+		conditions = append(conditions, "paused")
+	}
+	if cfg.unthrottled > 0 {
+		conditions = append(conditions, fmt.Sprintf("first %d bytes unthrottled", cfg.unthrottled))
+	}
+	if cfg.windowClamp > 0 {
+		conditions = append(conditions, fmt.Sprintf("window clamp %d on %s", cfg.windowClamp, cfg.windowClampLeg))
+	}
+	latency, jitter := c.currentLatency(cfg)
+	if latency > 0 {
+		conditions = append(conditions, fmt.Sprintf("latency %v", latency))
+	}
+	if jitter > 0 {
+		conditions = append(conditions, fmt.Sprintf("jitter %v %s", jitter, cfg.jitterDist))
+	}
+	if c.down.ReadSize > 0 {
+		conditions = append(conditions, fmt.Sprintf("upstream reads of %d bytes", c.down.ReadSize))
+	}
+	if c.down.ReadGap > 0 {
+		conditions = append(conditions, fmt.Sprintf("upstream read gap %v", c.down.ReadGap))
+	}
+	if c.down.CloseDelay > 0 {
+		conditions = append(conditions, fmt.Sprintf("close delay %v", c.down.CloseDelay))
+	}
+	if cfg.killRate > 0 {
+		conditions = append(conditions, fmt.Sprintf("killed with %s at %g/s", cfg.killWith, cfg.killRate))
+	}
+	if cfg.idleReset > 0 {
+		conditions = append(conditions, fmt.Sprintf("idle reset %v", cfg.idleReset))
+	}
+	if cfg.idleStall > 0 {
+		conditions = append(conditions, fmt.Sprintf("idle stall %v for %v", cfg.idleStall, cfg.idleStallFor))
+		if cfg.idleStallMax > 0 {
+			conditions[len(conditions)-1] += fmt.Sprintf(" at most %d times", cfg.idleStallMax)
+		}
+	}
+	if cfg.migrateEvery > 0 {
+		conditions = append(conditions, fmt.Sprintf("migrate every %v, gap %v, %s", cfg.migrateEvery, cfg.migrateGap,
+			cfg.migratePolicy))
+	}
+	if cfg.reconnect > 0 {
+		conditions = append(conditions, fmt.Sprintf("reconnect for %v", cfg.reconnect))
+		if cfg.reconnectReplay > 0 {
+			conditions[len(conditions)-1] += fmt.Sprintf(" replaying %d bytes", cfg.reconnectReplay)
+		}
+	}
+	if c.up.Messages != nil {
+		conditions = append(conditions, fmt.Sprintf("message rate %g/s %s", cfg.messageRate, cfg.framing))
+	}
+	for _, p := range []*pipe{c.up, c.down} {
+		if p.Corrupter == nil {
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("garble %s %g, truncate %s %g", p.direction(),
+			p.Corrupter.Garble, p.direction(), p.Corrupter.Truncate))
+	}
+	for _, p := range []*pipe{c.up, c.down} {
+		if p.Blackhole > 0 {
+			conditions = append(conditions, fmt.Sprintf("blackhole %s above %d bytes", p.direction(), p.Blackhole))
+		}
+	}
+	return strings.Join(conditions, ", ")
+}
+
+// pipe is one direction of a proxied connection, which relays it under the conditions of cfg that change over the
+// life of the connection, eg. with runtime changes, quotas and idle faults.
+type pipe struct {
+	*relay.Pipe
+	conn         *connection
+	cfg          *config
+	wName, rName string // identify W and R in logs
+	throughput   int    // bytes per second when the connection was opened
+	pinned       bool   // throughput is fixed for the connection, eg. by an -sni-route
+	monitor      bottleneckMonitor
+}
+
+func newPipe(c *connection, cfg *config, direction relay.Direction, w, r endpoint, wName, rName string,
+	throughput int, shared *pacer.Shared) *pipe {
+	p := &pipe{conn: c, cfg: cfg, wName: wName, rName: rName, throughput: throughput,
+		monitor: bottleneckMonitor{windowStart: time.Now()}}
+	p.Pipe = &relay.Pipe{Direction: direction, W: w, R: r, Conditions: p, Shared: shared,
+		Unthrottled: cfg.unthrottled}
+	return p
+}
+
+// run relays with a buffer from bufPool until the pipe is done.
+func (p *pipe) run(bufPool *sync.Pool) {
+	bufPtr := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bufPtr)
+	p.Run(*bufPtr)
+}
+
+// Throughput waits while transfers are paused and returns the current throughput, reduced or blocked once the client
+// exceeded its quota.
+func (p *pipe) Throughput() (int, bool) {
+	cfg := p.cfg
+	cfg.live.waitWhilePaused()
+
+	throughput := p.currentThroughput()
+	if cfg.overQuota(p.conn.account) {
+		if cfg.quotaAction == "block" {
+			if atomic.CompareAndSwapUint32(&p.conn.overQuota, 0, 1) {
+				log.Printf("%s: quota of %d bytes exceeded, blocked", p.conn.name, cfg.quota)
+			}
+			p.conn.endedBy("quota")
+			return 0, false
+		}
+		if atomic.CompareAndSwapUint32(&p.conn.overQuota, 0, 1) {
+			log.Printf("%s: quota of %d bytes exceeded, throttled to %d bytes/s", p.conn.name, cfg.quota,
+				cfg.quotaThroughput)
+			p.conn.noteConditions(cfg)
+		}
+		throughput = min(throughput, cfg.quotaThroughput)
+	}
+	return throughput, true
+}
+
+// Received labels the connection by its first request and stalls or resets it after it was idle.
+func (p *pipe) Received(chunk []byte) bool {
+	cfg := p.cfg
+	if cfg.labelHTTP && !cfg.noSniff[p.conn.listener] && p.Direction == relay.Up && p.conn.getLabel() == "" {
+		if label := httpRequestLabel(chunk); label != "" {
+			p.conn.label.Store(label)
+			log.Printf("%s: %s", p.conn.name, label)
+		}
+	}
+
+	idle := p.conn.idle()
+	p.conn.touch()
+	if cfg.idleStall > 0 && idle >= cfg.idleStall {
+		log.Printf("%s: idle for %v, stalling for %v", p.conn.name, idle.Round(time.Millisecond), cfg.idleStallFor)
+		// the connection is not idle while the data is held back
+		p.conn.touchAt(time.Now().Add(cfg.idleStallFor))
+		time.Sleep(cfg.idleStallFor)
+		if cfg.idleStallMax > 0 && atomic.AddUint32(&p.conn.stalls, 1) >= cfg.idleStallMax {
+			log.Printf("%s: stalled %d times, reset", p.conn.name, cfg.idleStallMax)
+			p.conn.endedBy("stall-reset")
+			reset(p.conn.client)
+			reset(p.conn.upstream)
+			return false
+		}
+	}
+	return true
+}
+
+// Blackholed logs the chunk that stalled the pipe at the blackhole.
+func (p *pipe) Blackholed(size int) {
+	log.Printf("%s: stalled %s by %d bytes above the blackhole size of %d bytes", p.conn.name, p.direction(), size,
+		p.Blackhole)
+}
+
+// Latency returns the latency of the connection for the next chunk, with jitter.
+func (p *pipe) Latency() time.Duration {
+	return p.conn.chunkLatency(p.cfg)
+}
+
+// Forwarded counts n bytes towards the client's quota and logs a NOTICE when shaping is not the bottleneck.
+func (p *pipe) Forwarded(n, throughput int, slept time.Duration) {
+	if p.conn.account != nil {
+		p.conn.account.add(n)
+	}
+	if achieved, elapsed, notice := p.monitor.observe(n, slept > 0); notice {
+		log.Printf("%s: NOTICE: %d bytes/s over the last %v is below the cap of %d bytes/s, shaping is not the "+
+			"bottleneck", p.rName, achieved, elapsed.Round(time.Second), throughput)
+	}
+}
+
+// Ended logs the end of the pipe and records why the connection ends.
+func (p *pipe) Ended(side string, err error) {
+	name := p.rName
+	if side == p.Direction.WriteSide() {
+		name = p.wName
+	}
+	if err != nil {
+		p.conn.logf(logEntry{Event: "error", Direction: p.direction(), Side: side, Error: err.Error()},
+			"%s: unexpected error: %v", name, err)
+		p.conn.endedBy(side + errorReason(err))
+		return
+	}
+	p.conn.logf(logEntry{Event: "closed", Direction: p.direction(), Side: side}, "%s: closed", name)
+	if side == p.Direction.WriteSide() {
+		// the side stopped reading
+		p.conn.endedBy(side + "-closed")
+		return
+	}
+	p.conn.endedBy(side + "-eof")
+	if p.CloseDelay > 0 {
+		log.Printf("%s: delaying close by %v", p.wName, p.CloseDelay)
+	}
+}
+
+// blackholeFor returns the size above which chunks stall direction, upstream or downstream, and datagrams are dropped,
+// or 0 for no blackhole.
+func (cfg *config) blackholeFor(direction string) int {
+	if cfg.blackholeDirection != "both" && cfg.blackholeDirection != direction {
+		return 0
+	}
+	return cfg.blackholeAbove
+}
+
+// bottleneckMonitor detects when shaping is not what limits a copy direction, i.e. when the peer sends or receives
+// slower than the configured throughput for a sustained period. Such connections silently run unconstrained, which
+// invalidates an experiment.
+type bottleneckMonitor struct {
+	windowStart time.Time
+	bytes       int
+	throttled   bool
+	noticed     bool
+}
+
+// observe records the amount of transmitted data and whether it had to be throttled. At the end of each noticeWindow
+// it reports the achieved throughput (bytes per second) and the elapsed time; notice is true only for the first
+// window of an episode in which data flowed but nothing was throttled.
+func (m *bottleneckMonitor) observe(transmitted int, throttled bool) (achieved int, elapsed time.Duration,
+	notice bool) {
+	m.bytes += transmitted
+	m.throttled = m.throttled || throttled
+
+	elapsed = time.Since(m.windowStart)
+	if elapsed < noticeWindow {
+		return 0, elapsed, false
+	}
+
+	achieved = int(float64(m.bytes) / elapsed.Seconds())
+	if m.throttled {
+		m.noticed = false
+	} else if m.bytes > 0 && !m.noticed {
+		m.noticed = true
+		notice = true
+	}
+
+	m.windowStart = time.Now()
+	m.bytes = 0
+	m.throttled = false
+	return achieved, elapsed, notice
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// execConn is an endpoint backed by the stdin and stdout of a process, which allows forwarding to protocol handlers
+// that do not listen on the network. The process's stderr goes to the log.
+type execConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+// startExec starts command, split at spaces into the program and its arguments.
+func startExec(command string) (*execConn, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = log.Writer()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+func (c *execConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *execConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseRead closes the process's stdout.
+func (c *execConn) CloseRead() error {
+	return c.stdout.Close()
+}
+
+// CloseWrite closes the process's stdin, which usually makes it exit once it has processed its input.
+func (c *execConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+// Close closes stdin and stdout and kills the process if it is still running.
+func (c *execConn) Close() error {
+	c.stdin.Close()
+	c.stdout.Close()
+	c.cmd.Process.Kill()
+	err := c.cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// exiting with an error or being killed is how such processes usually end
+		return nil
+	}
+	return err
+}
+
+// String identifies the process in logs, eg. cat[1234].
+func (c *execConn) String() string {
+	return fmt.Sprintf("%s[%d]", c.cmd.Path, c.cmd.Process.Pid)
+}
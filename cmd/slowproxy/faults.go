@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// processStart anchors the times of activity, which are kept as durations since then on the monotonic clock, so jumps
+// of the wall clock, eg. from suspending a laptop, do not make connections idle or active.
+var processStart = time.Now()
+
+// sinceStart returns t, which has to come from time.Now, as the duration since processStart.
+func sinceStart(t time.Time) int64 {
+	return int64(t.Sub(processStart))
+}
+
+// touch records activity on the connection.
+func (c *connection) touch() {
+	c.touchAt(time.Now())
+}
+
+// touchAt records activity on the connection at t, which may lie in the future to keep it from becoming idle.
+func (c *connection) touchAt(t time.Time) {
+	atomic.StoreInt64(&c.lastActivity, sinceStart(t))
+}
+
+// idle returns how long the connection has been idle in both directions.
+func (c *connection) idle() time.Duration {
+	return time.Duration(sinceStart(time.Now()) - atomic.LoadInt64(&c.lastActivity))
+}
+
+// resetWhenIdle resets the connection once it has been idle for idleReset, like a middlebox dropping the flow: both
+// the client and the upstream receive a RST rather than a FIN, which clients often handle differently. It returns
+// early when done is closed.
+func (c *connection) resetWhenIdle(idleReset time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(idleReset)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		idle := c.idle()
+		if idle < idleReset {
+			timer.Reset(idleReset - idle)
+			continue
+		}
+		log.Printf("%s: idle for %v, reset", c.name, idle.Round(time.Millisecond))
+		c.endedBy("idle-reset")
+		reset(c.client)
+		reset(c.upstream)
+		return
+	}
+}
+
+// killRandomly kills the connection after a random, exponentially distributed lifetime with a mean of 1/rate
+// seconds, to test reconnect logic against flaky networks. With rst the connection is reset, otherwise it is closed
+// normally. It returns early when done is closed.
+func (c *connection) killRandomly(rate float64, rst bool, done <-chan struct{}) {
+	timer := time.NewTimer(time.Duration(rand.ExpFloat64() / rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	if rst {
+		log.Printf("%s: killed, reset", c.name)
+		c.endedBy("killed-rst")
+		reset(c.client)
+		reset(c.upstream)
+		return
+	}
+	log.Printf("%s: killed, closed", c.name)
+	c.endedBy("killed-fin")
+	c.client.Close()
+	c.upstream.Close()
+}
+
+// reset closes e, with a RST instead of a FIN if it is a TCP connection or TLS over one.
+func reset(e endpoint) {
+	if conn, ok := tcpConnOf(e); ok {
+		conn.SetLinger(0)
+	}
+	e.Close()
+}
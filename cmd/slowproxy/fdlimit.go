@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fdReserve is the number of file descriptors set aside for everything but connections: stdio, the listener, the log
+// file, the ledger and the metrics exporter.
+const fdReserve = 16
+
+// checkFileLimit verifies that the file descriptor limit allows maxConns connections, each of which takes two
+// descriptors. There is no need to raise the limit: the Go runtime raises the soft limit to the hard limit at startup.
+func checkFileLimit(maxConns int) error {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return err
+	}
+	if needed := uint64(2*maxConns + fdReserve); maxConns > 0 && limit.Cur < needed {
+		return fmt.Errorf("file descriptor limit %d allows about %d connections, fewer than -max-conns %d",
+			limit.Cur, (limit.Cur-min(limit.Cur, fdReserve))/2, maxConns)
+	}
+	return nil
+}
+
+// openFiles returns the number of open file descriptors and their limit, or -1 for either if it is unknown.
+func openFiles() (int, int) {
+	open := -1
+	if entries, err := os.ReadDir("/dev/fd"); err == nil {
+		open = len(entries) - 1 // reading the directory takes a descriptor itself
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return open, -1
+	}
+	return open, int(limit.Cur)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+// checkFileLimit does nothing where there is no file descriptor limit to check.
+func checkFileLimit(maxConns int) error {
+	return nil
+}
+
+// openFiles returns -1 since the open files and their limit are unknown.
+func openFiles() (int, int) {
+	return -1, -1
+}
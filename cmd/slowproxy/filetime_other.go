@@ -0,0 +1,14 @@
+//go:build !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileCreated returns the modification time of the file described by info, since the platform does not tell when it
+// was created: a file appended to by an earlier run is at least as old as its last write.
+func fileCreated(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fuzz targets feed arbitrary client input to the parsers of what clients send, which must neither panic nor read
+// more than their limits allow, see sniff.go. Run one with eg. go test -fuzz FuzzReadSOCKSRequest ./cmd/slowproxy.
+
+// fuzzConn is a client connection sending data, which counts the bytes read from it and discards what is written.
+type fuzzConn struct {
+	net.Conn // not set, the parsers must not use other methods
+	data     *bytes.Reader
+	read     int
+}
+
+func newFuzzConn(data []byte) *fuzzConn {
+	return &fuzzConn{data: bytes.NewReader(data)}
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error) {
+	n, err := c.data.Read(p)
+	c.read += n
+	return n, err
+}
+
+func (c *fuzzConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *fuzzConn) Close() error                       { return nil }
+func (c *fuzzConn) CloseRead() error                   { return nil }
+func (c *fuzzConn) CloseWrite() error                  { return nil }
+func (c *fuzzConn) SetReadDeadline(time.Time) error    { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80} }
+func (c *fuzzConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000} }
+func (c *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// clientHello returns the first TLS record of a handshake for serverName.
+func clientHello(t testing.TB, serverName string) []byte {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closing it ends the handshake
+	defer server.Close()
+	return readTLSRecord(server.(*net.TCPConn))
+}
+
+func FuzzHTTPRequestLabel(f *testing.F) {
+	f.Add([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Add([]byte("POST " + strings.Repeat("/a", 100) + " HTTP/1.0\n"))
+	f.Add([]byte("\x16\x03\x01\x00\x05hello"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		label := httpRequestLabel(data)
+		if len(label) > maxLabelLength || !printable(label) {
+			t.Errorf("label %q", label)
+		}
+		if label != "" && !bytes.Contains(data[:min(len(data), maxRequestLine)], []byte("\n")) {
+			t.Errorf("label %q from beyond %d bytes", label, maxRequestLine)
+		}
+	})
+}
+
+func FuzzClientHelloServerName(f *testing.F) {
+	for _, name := range []string{"example.com", "a-b.c_d.example"} {
+		record := clientHello(f, name)
+		if got := clientHelloServerName(record); got != name {
+			f.Fatalf("server name %q in the ClientHello for %q", got, name)
+		}
+		f.Add(record)
+	}
+	f.Add([]byte("\x16\x03\x01\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newFuzzConn(data)
+		record := readTLSRecord(conn)
+		if conn.read > maxTLSRecord || len(record) > maxTLSRecord {
+			t.Errorf("read %d bytes for a record of %d bytes", conn.read, len(record))
+		}
+		if name := clientHelloServerName(record); name != "" && !validHostName(name) {
+			t.Errorf("server name %q", name)
+		}
+	})
+}
+
+func FuzzReadSOCKSRequest(f *testing.F) {
+	f.Add([]byte("\x05\x01\x00\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x50"))
+	f.Add([]byte("\x05\x02\x02\x00\x05\x01\x00\x03\x0bexample.com\x01\xbb"))
+	f.Add([]byte("\x05\x01\x00\x05\x01\x00\x04" +
+		"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x50"))
+	f.Add([]byte("\x05\x01\x02"))
+	// the greeting, the request and the longest address, a domain of 255 bytes, with the port
+	const limit = 2 + 255 + 4 + 1 + 255 + 2
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newFuzzConn(data)
+		address, err := readSOCKSRequest(conn)
+		if conn.read > limit {
+			t.Errorf("read %d bytes", conn.read)
+		}
+		if err != nil {
+			return
+		}
+		if host, _, err := net.SplitHostPort(address); err != nil || net.ParseIP(host) == nil && !validHostName(host) {
+			t.Errorf("address %q", address)
+		}
+	})
+}
+
+func FuzzReadProxyHeader(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\nGET / HTTP/1.0\r\n\r\n"))
+	f.Add([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	for _, source := range []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000},
+		nil,
+	} {
+		destination := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+		f.Add(proxyHeader("v2", source, destination))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newFuzzConn(data)
+		_, err := readProxyHeader(conn)
+		// a version 1 line of at most maxProxyV1Line bytes and its newline, or a version 2 header with its addresses
+		limit := maxProxyV1Line + 1
+		if len(data) > 0 && data[0] == proxyV2Signature[0] {
+			limit = 16 + 0xffff
+		}
+		if conn.read > limit {
+			t.Errorf("read %d bytes", conn.read)
+		}
+		if err == nil && conn.read == 0 {
+			t.Error("accepted an empty header")
+		}
+	})
+}
+
+func FuzzReadHops(f *testing.F) {
+	f.Add([]byte(hopPrefix + "throughput=100000;up=10 down=20\napplication data"))
+	f.Add([]byte(hopPrefix + "\x1b[2J\n"))
+	f.Add([]byte(strings.Repeat("x", maxHopLine+10) + "\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newFuzzConn(data)
+		hops, err := readHops(conn)
+		if conn.read > maxHopLine+1 {
+			t.Errorf("read %d bytes", conn.read)
+		}
+		for _, hop := range hops {
+			if !printable(hop) {
+				t.Errorf("hop %q", hop)
+			}
+		}
+		if err == nil && !bytes.HasPrefix(data, []byte(hopPrefix)) {
+			t.Error("accepted a line without the prefix")
+		}
+	})
+}
+
+func FuzzReadLine(f *testing.F) {
+	f.Add([]byte("line\nrest"), 10)
+	f.Add([]byte("no newline"), 100)
+	f.Add([]byte("too long\n"), 3)
+	f.Fuzz(func(t *testing.T, data []byte, maxLength int) {
+		maxLength = max(0, min(maxLength, 1<<16))
+		conn := newFuzzConn(data)
+		line, err := readLine(conn, time.Second, maxLength)
+		if conn.read > maxLength+1 || len(line) > maxLength {
+			t.Errorf("read %d bytes for a line of %d bytes", conn.read, len(line))
+		}
+		if err == nil && (conn.read != len(line)+1 || data[len(line)] != '\n') {
+			t.Errorf("line %q does not end at the first newline", line)
+		}
+	})
+}
+
+func FuzzReadTenant(f *testing.F) {
+	cfg := &config{forward: "localhost:80", tenants: routes{"phone1": {forward: "10.0.0.1:80"}}}
+	f.Add([]byte("phone1\nGET / HTTP/1.0\r\n\r\n"))
+	f.Add([]byte("\n"))
+	f.Add([]byte(" PHONE1 \r\n"))
+	f.Add([]byte("unknown\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newFuzzConn(data)
+		_, r, err := cfg.readTenant(conn)
+		if conn.read > maxTenantLine+1 {
+			t.Errorf("read %d bytes", conn.read)
+		}
+		if err == nil && r.forward != cfg.forward && r.forward != "10.0.0.1:80" {
+			t.Errorf("route %v", r)
+		}
+	})
+}
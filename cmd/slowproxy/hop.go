@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopPrefix starts the single line of hop metadata exchanged between chained slowproxy instances. The line lists the
+// conditions applied by every hop so far, separated by semicolons, eg.
+//
+//	SLOWPROXY-HOPS throughput=100000;throughput=20000
+const hopPrefix = "SLOWPROXY-HOPS "
+
+// maxHopLine limits the length of the hop metadata line so a misconfigured downstream cannot make us buffer
+// arbitrary amounts of data.
+const maxHopLine = 4096
+
+// hopTimeout is how long to wait for the downstream to send its hop metadata.
+const hopTimeout = 5 * time.Second
+
+// hopConditions describes the conditions this instance applies in the format used in the hop metadata:
+// throughput=N, or up=N down=N for different throughputs per direction.
+func (cfg *config) hopConditions() string {
+	up, down := cfg.live.currentThroughput()
+	if up == down {
+		return fmt.Sprintf("throughput=%d", down)
+	}
+	return fmt.Sprintf("up=%d down=%d", up, down)
+}
+
+// readHops reads the hop metadata line sent by a downstream slowproxy, within hopTimeout.
+func readHops(conn io.Reader) ([]string, error) {
+	line, err := readLine(conn, hopTimeout, maxHopLine)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, hopPrefix) || !printable(line) {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	return strings.Split(strings.TrimPrefix(line, hopPrefix), ";"), nil
+}
+
+// readLine reads a line of at most maxLength bytes without the newline. The line is read byte by byte so that no
+// application data following it is consumed. If conn supports deadlines, reading the line times out after timeout.
+func readLine(conn io.Reader, timeout time.Duration, maxLength int) (string, error) {
+	deadliner, hasDeadline := conn.(interface{ SetReadDeadline(time.Time) error })
+	if hasDeadline {
+		if err := deadliner.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return "", err
+		}
+	}
+
+	var line bytes.Buffer
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if line.Len() >= maxLength {
+			return "", errors.New("line too long")
+		}
+		line.WriteByte(b[0])
+	}
+
+	if hasDeadline {
+		if err := deadliner.SetReadDeadline(time.Time{}); err != nil {
+			return "", err
+		}
+	}
+	return line.String(), nil
+}
+
+// writeHops sends the hop metadata line to an upstream slowproxy.
+func writeHops(conn io.Writer, hops []string) error {
+	_, err := conn.Write([]byte(hopPrefix + strings.Join(hops, ";") + "\n"))
+	return err
+}
+
+// formatHops describes the path for the log including the effective throughput, which is the lowest throughput of all
+// hops in each direction.
+func formatHops(hops []string) string {
+	up, down := math.MaxInt, math.MaxInt
+	for _, hop := range hops {
+		for _, condition := range strings.Fields(hop) {
+			key, value, _ := strings.Cut(condition, "=")
+			throughput, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "throughput":
+				up, down = min(up, throughput), min(down, throughput)
+			case "up":
+				up = min(up, throughput)
+			case "down":
+				down = min(down, throughput)
+			}
+		}
+	}
+
+	effective := fmt.Sprintf("throughput=%d", down)
+	if up != down {
+		effective = fmt.Sprintf("up=%d down=%d", up, down)
+	}
+	return fmt.Sprintf("%s (effective %s)", strings.Join(hops, " -> "), effective)
+}
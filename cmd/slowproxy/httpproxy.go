@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// httpRoute is the throughput applied to the requests for the paths starting with prefix, see -http-route.
+type httpRoute struct {
+	prefix     string
+	throughput int // bytes per second in each direction, 0 for no limit
+}
+
+// httpRoutes is a flag.Value for the throughput by path prefix, given as PREFIX=THROUGHPUT separated by commas or in
+// repeated flags, eg. /downloads/*=100k,/api/=0. A trailing * is optional. The longest matching prefix wins.
+type httpRoutes []httpRoute
+
+func (r *httpRoutes) String() string {
+	if r == nil {
+		return ""
+	}
+	specs := make([]string, len(*r))
+	for i, route := range *r {
+		specs[i] = fmt.Sprintf("%s=%d", route.prefix, route.throughput)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (r *httpRoutes) Set(s string) error {
+	for _, spec := range strings.Split(s, ",") {
+		prefix, throughput, ok := strings.Cut(spec, "=")
+		prefix = strings.TrimSuffix(prefix, "*")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("%s is not a route of the form /PREFIX=THROUGHPUT", spec)
+		}
+		route := httpRoute{prefix: prefix}
+		var err error
+		if route.throughput, err = parseThroughput(throughput); err != nil {
+			return err
+		}
+		*r = append(*r, route)
+	}
+	// longest prefix first, so the first match is the most specific one
+	sort.SliceStable(*r, func(i, j int) bool { return len((*r)[i].prefix) > len((*r)[j].prefix) })
+	return nil
+}
+
+// match returns the route for path, if any.
+func (r httpRoutes) match(path string) (httpRoute, bool) {
+	for _, route := range r {
+		if strings.HasPrefix(path, route.prefix) {
+			return route, true
+		}
+	}
+	return httpRoute{}, false
+}
+
+// httpDrainTimeout is how long the requests in progress are given to complete on shutdown with -proto http.
+const httpDrainTimeout = 30 * time.Second
+
+// httpServer returns the server for -proto http, a reverse proxy to the forward address. Unlike the TCP proxy it
+// understands the requests: each is logged with its status, and -http-route applies different throughputs to
+// different paths, eg. to throttle downloads but not API calls. The throughput of a route applies to each request on
+// its own. Requests without a route get THROUGHPUT, shared by all of them with -shared, the latency and the pause,
+// following runtime changes. -max-conns limits the requests in progress rather than the connections.
+func (px *proxy) httpServer() *http.Server {
+	cfg := px.cfg
+	network, address := splitAddress(cfg.forward)
+	target := address
+	if network != "tcp" {
+		target = "localhost"
+	}
+	scheme := "http"
+	if cfg.upstreamTLS != nil {
+		scheme = "https"
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if network == "pipe" {
+				return dialPipe(address)
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSClientConfig:     cfg.upstreamTLS,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme, r.Out.URL.Host = scheme, target
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			px.dialErrors.add(errorClass(err))
+			log.Printf("%s: %s %s: %v", cfg.clientName(remoteAddr(r)), r.Method, r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if reason := px.overloaded(); reason != "" {
+			log.Printf("%s: rejected %s %s, %s", cfg.clientName(remoteAddr(r)), r.Method, r.URL.Path, reason)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt64(&px.active, 1)
+		defer atomic.AddInt64(&px.active, -1)
+
+		start := time.Now()
+		upThroughput := func() int { up, _ := cfg.live.currentThroughput(); return up }
+		downThroughput := func() int { _, down := cfg.live.currentThroughput(); return down }
+		sharedUp, sharedDown := px.sharedUp, px.sharedDown
+		routed := ""
+		if route, ok := cfg.httpRoutes.match(r.URL.Path); ok {
+			upThroughput = func() int { return route.throughput }
+			downThroughput = upThroughput
+			sharedUp, sharedDown = nil, nil
+			routed = ", route " + route.prefix
+		}
+
+		body := &pacedReader{ReadCloser: r.Body, cfg: cfg, throughput: upThroughput, shared: sharedUp}
+		r.Body = body
+		recorder := &pacedResponseWriter{ResponseWriter: w, cfg: cfg, throughput: downThroughput, shared: sharedDown,
+			status: http.StatusOK}
+		reverseProxy.ServeHTTP(recorder, r)
+		log.Printf("%s: %s %s %d, up %d bytes, down %d bytes in %v%s", cfg.clientName(remoteAddr(r)), r.Method,
+			r.URL.Path, recorder.status, body.transferred, recorder.transferred,
+			time.Since(start).Round(time.Millisecond), routed)
+	}
+
+	return &http.Server{Handler: http.HandlerFunc(handler), ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog: log.Default()}
+}
+
+// serveHTTP serves requests on listener with server until drainHTTP is called.
+func serveHTTP(server *http.Server, listener net.Listener) {
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("http: %v", err)
+	}
+}
+
+// drainHTTP stops server from accepting connections and waits up to httpDrainTimeout for the requests in progress to
+// complete, as slowed down as they are.
+func drainHTTP(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpDrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("http: stopped waiting for the requests in progress: %v", err)
+	}
+}
+
+// remoteAddr returns the client's address of r.
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.UnixAddr{Name: r.RemoteAddr, Net: "unix"}
+	}
+	return addr
+}
+
+// pacedReader paces reading a request body to the throughput towards the upstream, with the latency applied to each
+// chunk like in the TCP proxy. A throughput of 0 does not limit it. With shared, the throughput is shared with the
+// other requests instead.
+type pacedReader struct {
+	io.ReadCloser
+	cfg         *config
+	throughput  func() int
+	pace        pacer.Pacer
+	shared      *pacer.Shared
+	transferred int64
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	r.cfg.live.waitWhilePaused()
+	throughput := r.throughput()
+	if throughput > 0 {
+		p = p[:min(len(p), throughput)]
+	}
+	start := time.Now()
+	if latency := r.cfg.chunkLatency(); latency > 0 {
+		time.Sleep(latency)
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.transferred += int64(n)
+	switch {
+	case throughput <= 0 || n == 0:
+	case r.shared != nil:
+		r.shared.Wait(throughput, n)
+	default:
+		r.pace.Delay(throughput, n, start)
+	}
+	return n, err
+}
+
+// pacedResponseWriter paces writing a response to the throughput towards the client, like pacedReader, and records
+// the status and size of the response.
+type pacedResponseWriter struct {
+	http.ResponseWriter
+	cfg         *config
+	throughput  func() int
+	pace        pacer.Pacer
+	shared      *pacer.Shared
+	status      int
+	transferred int64
+}
+
+func (w *pacedResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pacedResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		w.cfg.live.waitWhilePaused()
+		throughput := w.throughput()
+		size := len(p)
+		if throughput > 0 {
+			size = min(size, throughput)
+		}
+		if throughput > 0 && w.shared != nil {
+			w.shared.Wait(throughput, size)
+		}
+		start := time.Now()
+		if latency := w.cfg.chunkLatency(); latency > 0 {
+			time.Sleep(latency)
+		}
+		n, err := w.ResponseWriter.Write(p[:size])
+		written += n
+		w.transferred += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if throughput > 0 && w.shared == nil {
+			w.pace.Delay(throughput, n, start)
+		}
+		p = p[size:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, eg. to flush streamed responses.
+func (w *pacedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pausePollInterval is how often paused transfers check whether they may continue.
+const pausePollInterval = 100 * time.Millisecond
+
+// controls holds the conditions that can be changed while the proxy is running. All fields are accessed atomically.
+type controls struct {
+	up, down        int64 // throughput towards the upstream and towards the client in bytes per second
+	latency, jitter int64 // delay of every chunk and the scale of its random variation in nanoseconds
+	paused          uint32
+}
+
+// currentThroughput returns the throughput towards the upstream and towards the client.
+func (c *controls) currentThroughput() (up, down int) {
+	return int(atomic.LoadInt64(&c.up)), int(atomic.LoadInt64(&c.down))
+}
+
+func (c *controls) setThroughput(up, down int) {
+	atomic.StoreInt64(&c.up, int64(up))
+	atomic.StoreInt64(&c.down, int64(down))
+}
+
+// currentLatency returns the delay of every chunk and the scale of its random variation.
+func (c *controls) currentLatency() (latency, jitter time.Duration) {
+	return time.Duration(atomic.LoadInt64(&c.latency)), time.Duration(atomic.LoadInt64(&c.jitter))
+}
+
+func (c *controls) setLatency(latency, jitter time.Duration) {
+	atomic.StoreInt64(&c.latency, int64(latency))
+	atomic.StoreInt64(&c.jitter, int64(jitter))
+}
+
+func (c *controls) isPaused() bool {
+	return atomic.LoadUint32(&c.paused) != 0
+}
+
+// togglePause pauses or resumes all transfers and returns whether they are paused now.
+func (c *controls) togglePause() bool {
+	for {
+		paused := atomic.LoadUint32(&c.paused)
+		if atomic.CompareAndSwapUint32(&c.paused, paused, 1-paused) {
+			return paused == 0
+		}
+	}
+}
+
+// setPaused pauses or resumes all transfers and returns whether that changed anything.
+func (c *controls) setPaused(paused bool) bool {
+	var value uint32
+	if paused {
+		value = 1
+	}
+	return atomic.SwapUint32(&c.paused, value) != value
+}
+
+// waitWhilePaused blocks as long as transfers are paused.
+func (c *controls) waitWhilePaused() {
+	for c.isPaused() {
+		time.Sleep(pausePollInterval)
+	}
+}
+
+// formatThroughput describes the throughput in both directions, eg. "1000 bytes/s" or "down 1000 bytes/s, up 100
+// bytes/s".
+func formatThroughput(up, down int) string {
+	if up == down {
+		return fmt.Sprintf("%d bytes/s", down)
+	}
+	return fmt.Sprintf("down %d bytes/s, up %d bytes/s", down, up)
+}
+
+// interactiveHelp lists the commands understood by readCommands.
+const interactiveHelp = `commands:
+  t THROUGHPUT  set the throughput in bytes per second, or with units like 512k or 1.5Mbit
+  t DOWN UP     set the throughput towards the client and towards the upstream separately
+  p             pause or resume all transfers
+  s             show the current conditions
+  c             list the open connections and the conditions applied to each
+  d             show the distribution of the throughput achieved by closed connections
+  h             show this help`
+
+// readCommands reads commands from in, one per line, and applies them to cfg. The open connections are looked up in
+// conns. Changes are recorded in audit, which may be nil. Responses are written to out. It returns once in is
+// exhausted.
+func readCommands(in io.Reader, out io.Writer, cfg *config, conns *registry, audit *auditLog) {
+	fmt.Fprintln(out, interactiveHelp)
+	who := operator()
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "t":
+			if len(fields) != 2 && len(fields) != 3 {
+				fmt.Fprintln(out, "usage: t THROUGHPUT or t DOWN UP")
+				continue
+			}
+			var throughputs []int
+			for _, field := range fields[1:] {
+				throughput, err := parseThroughput(field)
+				if err != nil {
+					fmt.Fprintln(out, err)
+					break
+				}
+				if throughput <= 0 {
+					fmt.Fprintln(out, "the throughput must be at least 1 byte per second")
+					break
+				}
+				throughputs = append(throughputs, throughput)
+			}
+			if len(throughputs) != len(fields)-1 {
+				continue
+			}
+			down, up := throughputs[0], throughputs[len(throughputs)-1]
+			previousUp, previousDown := cfg.live.currentThroughput()
+			cfg.live.setThroughput(up, down)
+			conns.noteConditions(cfg)
+			audit.record(who, "interactive", "throughput down %d -> %d, up %d -> %d", previousDown, down,
+				previousUp, up)
+			fmt.Fprintf(out, "throughput set to %s\n", formatThroughput(up, down))
+		case "p":
+			paused := cfg.live.togglePause()
+			conns.noteConditions(cfg)
+			if paused {
+				audit.record(who, "interactive", "paused")
+				fmt.Fprintln(out, "paused")
+			} else {
+				audit.record(who, "interactive", "resumed")
+				fmt.Fprintln(out, "resumed")
+			}
+		case "s":
+			fmt.Fprintf(out, "throughput %s, paused %t\n", formatThroughput(cfg.live.currentThroughput()),
+				cfg.live.isPaused())
+		case "c":
+			open := conns.open()
+			if len(open) == 0 {
+				fmt.Fprintln(out, "no open connections")
+			}
+			for _, c := range open {
+				label := ""
+				if l := c.getLabel(); l != "" {
+					label = " " + l
+				}
+				fmt.Fprintf(out, "%d %s -> %s%s, open for %v: %s\n", c.id, c.name, c.up.wName, label,
+					time.Since(c.opened).Round(time.Second), c.effective(cfg))
+			}
+		case "d":
+			counts := conns.throughputs.snapshot()
+			if len(counts) == 0 {
+				fmt.Fprintln(out, "no closed connections")
+			}
+			for _, key := range sortedThroughputKeys(counts) {
+				fmt.Fprintf(out, "%s", key)
+				for i, n := range counts[key] {
+					fmt.Fprintf(out, "  <=%s: %d", conns.throughputs.bucketLabel(i), n)
+				}
+				fmt.Fprintln(out)
+			}
+		case "h":
+			fmt.Fprintln(out, interactiveHelp)
+		default:
+			fmt.Fprintf(out, "unknown command %s, h for help\n", fields[0])
+		}
+	}
+}
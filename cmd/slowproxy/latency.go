@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// chunkLatency returns how long to delay the next chunk: the current latency plus jitter, but never less than 0.
+func (cfg *config) chunkLatency() time.Duration {
+	latency, scale := cfg.live.currentLatency()
+	return pacer.Jittered(cfg.jitterDist, latency, scale)
+}
+
+// chunkLatency returns how long to delay the next chunk of the connection, see currentLatency.
+func (c *connection) chunkLatency(cfg *config) time.Duration {
+	latency, scale := c.currentLatency(cfg)
+	return pacer.Jittered(cfg.jitterDist, latency, scale)
+}
+
+// currentLatency returns the latency and jitter applied to the connection: those of its profile if it has one,
+// otherwise the current ones.
+func (c *connection) currentLatency(cfg *config) (latency, jitter time.Duration) {
+	if c.profile != nil {
+		return c.profile.latency, c.profile.jitter
+	}
+	return cfg.live.currentLatency()
+}
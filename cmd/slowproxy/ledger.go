@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ledgerSaveInterval is how often the ledger is written to disk while the proxy is running.
+const ledgerSaveInterval = 10 * time.Second
+
+// ledger keeps the cumulative number of bytes transferred per client IP address, in both directions, and persists
+// them in a JSON file so that quotas survive restarts.
+type ledger struct {
+	path string
+
+	mu       sync.Mutex
+	accounts map[string]*account
+}
+
+// account is the usage of a single client IP address. It is updated atomically so that copying data does not
+// contend for the ledger's lock.
+type account struct {
+	bytes int64
+}
+
+// loadLedger reads the ledger from the file at path. A missing file results in an empty ledger.
+func loadLedger(path string) (*ledger, error) {
+	l := &ledger{path: path, accounts: map[string]*account{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var usage map[string]int64
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	for ip, bytes := range usage {
+		l.accounts[ip] = &account{bytes: bytes}
+	}
+	return l, nil
+}
+
+// account returns the account of the IP address of addr, creating it if necessary.
+func (l *ledger) account(addr net.Addr) *account {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	acct, ok := l.accounts[ip]
+	if !ok {
+		acct = &account{}
+		l.accounts[ip] = acct
+	}
+	return acct
+}
+
+// save writes the ledger to its file. The file is replaced atomically so a crash never leaves a truncated ledger.
+func (l *ledger) save() error {
+	l.mu.Lock()
+	usage := make(map[string]int64, len(l.accounts))
+	for ip, acct := range l.accounts {
+		usage[ip] = acct.used()
+	}
+	l.mu.Unlock()
+
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// saveEvery saves the ledger periodically. It never returns.
+func (l *ledger) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := l.save(); err != nil {
+			log.Printf("ledger: %v", err)
+		}
+	}
+}
+
+// add records n transferred bytes.
+func (a *account) add(n int) {
+	atomic.AddInt64(&a.bytes, int64(n))
+}
+
+// used returns the number of bytes transferred so far.
+func (a *account) used() int64 {
+	return atomic.LoadInt64(&a.bytes)
+}
+
+// overQuota determines if the account acct has exceeded the configured quota. It is false if there is no account or
+// no quota.
+func (cfg *config) overQuota(acct *account) bool {
+	return acct != nil && cfg.quota > 0 && acct.used() >= cfg.quota
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"runtime/metrics"
+	"sync/atomic"
+)
+
+// memoryInUse returns the memory obtained from the OS and not yet returned to it in bytes, which approximates the RSS.
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// overloaded determines whether a new connection has to be rejected to stay within -max-conns and -max-memory, so the
+// proxy does not compete for resources with the system under test. It returns the reason, or "" to accept it.
+func (px *proxy) overloaded() string {
+	if px.cfg.maxConns > 0 && atomic.LoadInt64(&px.active) >= int64(px.cfg.maxConns) {
+		return fmt.Sprintf("%d connections open", px.cfg.maxConns)
+	}
+	if px.cfg.maxMemory > 0 {
+		if inUse := memoryInUse(); inUse > uint64(px.cfg.maxMemory) {
+			return fmt.Sprintf("%d bytes of memory in use", inUse)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.Writer for the log which starts a new file once the current one exceeds maxSize bytes or is
+// older than maxAge. Rotated files are renamed with a timestamp suffix and compressed with gzip, and only the newest
+// keep of them are retained. A zero maxSize or maxAge disables that rotation criterion.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time // when the file was created, as far as the platform tells, see fileCreated
+}
+
+// openRotatingFile opens (or creates) the log file at path, appending to it.
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write implements io.Writer. Errors while rotating are reported on stderr since they cannot be logged.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0) ||
+		(f.maxAge > 0 && time.Since(f.created) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// open opens the file at path and records its current size and age, so that a file appended to by an earlier run is
+// rotated just as if the proxy had kept running.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.created = fileCreated(info)
+	return nil
+}
+
+// rotate renames the current file and opens a new one. Compressing and pruning the rotated files happens in the
+// background so logging is not held up. If the rotation fails, the file at path is opened again to append to it, so
+// the logging goes on and the next write retries.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if errors.Is(err, os.ErrClosed) {
+		// the last rotation failed to open the file again
+		err = nil
+	}
+	if err == nil {
+		rotated := f.path + "." + time.Now().Format("20060102-150405.000")
+		if err = os.Rename(f.path, rotated); err == nil {
+			go f.compressAndPrune(rotated)
+		}
+	}
+	if openErr := f.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// compressAndPrune compresses the rotated file and removes the oldest rotated files beyond keep.
+func (f *rotatingFile) compressAndPrune(rotated string) {
+	if err := compressFile(rotated); err != nil {
+		fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+		return
+	}
+
+	// the timestamp suffix sorts chronologically
+	backups, err := filepath.Glob(f.path + ".*.gz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+		return
+	}
+	sort.Strings(backups)
+	for len(backups) > f.keep {
+		if err := os.Remove(backups[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// compressFile replaces the file at path by a gzip compressed copy with the suffix .gz.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonLog is the log in the JSON format, nil for the text format of package log.
+var jsonLog *jsonLogWriter
+
+// logEntry is a line of the JSON log. Connection events carry structured fields besides the message, which is the
+// line of the text format.
+type logEntry struct {
+	Time           time.Time `json:"time"`
+	Msg            string    `json:"msg"`
+	Event          string    `json:"event,omitempty"`     // eg. open, closed, error or ended
+	Conn           uint64    `json:"conn,omitempty"`      // the id of the connection
+	Client         string    `json:"client,omitempty"`    // the client's address, anonymized with -anonymize-salt
+	Upstream       string    `json:"upstream,omitempty"`  // the upstream's address
+	Direction      string    `json:"direction,omitempty"` // upstream or downstream
+	Side           string    `json:"side,omitempty"`      // client or upstream, the side an event happened on
+	Error          string    `json:"error,omitempty"`
+	Reason         string    `json:"reason,omitempty"` // why the connection ended, see connection.endedBy
+	BytesUp        *int64    `json:"bytes_up,omitempty"`
+	BytesDown      *int64    `json:"bytes_down,omitempty"`
+	ThroughputUp   *float64  `json:"throughput_up,omitempty"` // average in bytes per second
+	ThroughputDown *float64  `json:"throughput_down,omitempty"`
+	Duration       float64   `json:"duration,omitempty"` // in seconds
+}
+
+// jsonLogWriter writes the JSON log, one object per line. As the output of package log it wraps each message in a
+// logEntry with just the time and message.
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// useJSONLog switches the log to the JSON format, written to w.
+func useJSONLog(w io.Writer) {
+	jsonLog = &jsonLogWriter{w: w}
+	log.SetFlags(0)
+	log.SetOutput(jsonLog)
+}
+
+func (l *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := l.write(logEntry{Msg: strings.TrimSuffix(string(p), "\n")}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *jsonLogWriter) write(entry logEntry) error {
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// logf logs an event of the connection: in the text format like log.Printf, in the JSON format with the fields of
+// entry and those identifying the connection.
+func (c *connection) logf(entry logEntry, format string, args ...interface{}) {
+	if jsonLog == nil {
+		log.Printf(format, args...)
+		return
+	}
+	entry.Msg = fmt.Sprintf(format, args...)
+	entry.Conn, entry.Client, entry.Upstream = c.id, c.name, c.up.wName
+	jsonLog.write(entry)
+}
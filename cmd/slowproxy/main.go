@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// config holds the settings the proxy was started with.
+type config struct {
+	listen         string
+	forward        string
+	proto          string         // tcp, udp to relay datagrams, see serveUDP, or http, see httpServer
+	tlsCert        string         // certificate to terminate TLS from clients with, see tlsListener
+	tlsKey         string         // private key of tlsCert
+	tlsClientCA    string         // CA certificates that client certificates must be signed by, "" to not require any
+	upstreamTLS    *tls.Config    // wraps connections to the forward address in TLS if not nil
+	sniRoutes      routes         // routes by TLS server name, see routeBySNI
+	tenants        routes         // routes by the name in the first line sent by clients, see readTenant
+	socks5         bool           // forward to the destinations clients request as a SOCKS5 proxy instead of forward
+	udpIdleTimeout time.Duration  // UDP sessions without datagrams for this long end
+	httpRoutes     httpRoutes     // throughputs by path prefix with -proto http
+	forwardExec    string         // command to forward to instead of the forward address
+	forwardBuiltin string         // built-in upstream to forward to instead of the forward address, see newBuiltin
+	chargenRate    int            // bytes per second sent by the chargen built-in upstream
+	throughput     int            // bytes per second
+	upThroughput   int            // bytes per second towards the upstream, defaults to throughput
+	downThroughput int            // bytes per second towards the client, defaults to throughput
+	shared         bool           // the throughput is shared by all connections instead of applying to each
+	schedule       []scheduleStep // changes of the throughput over time, see parseSchedule
+	profile        string         // preset of the throughput, latency and jitter, see profiles
+	profileMix     profileMix     // profiles connections draw their own from
+	listenRoutes   listenRoutes   // further addresses to listen on, each forwarding to its own upstream
+	bdp            int            // bandwidth-delay product limiting the bytes in flight in the proxy, 0 for no limit
+	socketBuffer   int            // socket buffer size, -1 to match the copy buffers, 0 to leave it to the kernel
+	unthrottled    int64          // bytes at the start of each direction that are not throttled
+	coalesce       bool           // let the kernel coalesce small upstream writes instead of sending each read on as is
+	windowClamp    int            // receive window advertised on windowClampLeg in bytes, 0 for no clamp
+	windowClampLeg string         // leg the window clamp applies to: both, client or upstream
+	maxConns       int            // connections handled at the same time, further ones are rejected, 0 for no limit
+	bypassLoopback bool           // forward connections from loopback addresses without any conditions, see bypass
+	maxMemory      int64          // memory in bytes beyond which new connections are rejected, 0 for no limit
+	maxProcs       int            // CPUs executing Go code simultaneously, 0 for all
+	hopIn          bool           // expect hop metadata from the downstream slowproxy
+	hopOut         bool           // send hop metadata to the upstream slowproxy
+
+	// proxyProtocolOut is the version of the PROXY protocol header sent to the upstream, v1 or v2, see proxyHeader
+	proxyProtocolOut string
+	// proxyProtocolIn is what happens to the PROXY protocol header expected from clients: strip or pass, see
+	// proxyProtocolListener
+	proxyProtocolIn string
+
+	// anonymizeSalt enables replacing client IP addresses in logs with a salted hash, see clientName
+	anonymizeSalt string
+
+	closeDelay  time.Duration // delay before passing on the upstream's close to the client
+	lingerAlarm time.Duration // time after the first side closed beyond which a pair is reported as lingering
+	latency     time.Duration // delay of every chunk in each direction
+	jitter      time.Duration // scale of the random variation of the latency
+	jitterDist  string        // distribution of the variation, see pacer.Jitter
+
+	labelHTTP bool        // label connections with their first HTTP request line
+	noSniff   listenerSet // listen addresses whose clients are forwarded without looking at what they send
+
+	upstreamReadSize int           // maximum bytes per read from the upstream, 0 for no limit
+	upstreamReadGap  time.Duration // pause between reads from the upstream
+
+	ledgerPath      string // file keeping the bytes transferred per client IP address across restarts
+	quota           int64  // bytes per client IP address after which quotaAction applies, 0 for no quota
+	quotaAction     string // "block" or "throttle"
+	quotaThroughput int    // bytes per second once the quota is exceeded with quotaAction "throttle"
+
+	logFile    string        // log to this file instead of stderr
+	logFormat  string        // text or json, see logEntry
+	logMaxSize int64         // rotate the log file once it exceeds this size in bytes
+	logMaxAge  time.Duration // rotate the log file once it is older than this
+	logKeep    int           // number of compressed rotated log files to keep
+
+	influxURL      string        // InfluxDB write endpoint for per-connection samples
+	influxToken    string        // InfluxDB API token
+	influxInterval time.Duration // sampling window
+	sampleRate     float64       // fraction of connections that per-connection samples are exported for
+
+	statusListen string // address of the read-only status page, see serveStatus
+
+	idleReset    time.Duration // reset both sides of connections idle for this long, 0 to disable
+	idleStall    time.Duration // stall the first transfer after the connection has been idle for this long
+	idleStallFor time.Duration // how long to stall the first transfer after idleStall
+	idleStallMax uint32        // stalls after which the connection is reset, 0 for no limit
+
+	killRate float64 // connections killed at random per second and connection, 0 to disable
+	killWith string  // how connections are killed: rst or fin
+
+	migrateEvery  time.Duration // tear down and re-establish the upstream connection this often, 0 to disable
+	migrateGap    time.Duration // time without an upstream connection during a migration
+	migratePolicy string        // what happens to data sent during the gap: buffer or drop
+
+	reconnect       time.Duration // how long to redial an upstream that dropped under a connected client, 0 to disable
+	reconnectReplay int           // bytes last sent to the upstream to send again to the new connection
+
+	messageRate float64 // messages per second and direction, 0 for no limit
+	framing     string  // how messages are delimited, see pacer.CheckFraming
+
+	garbleLines      float64 // probability of inserting a garbage line before a line
+	truncateLines    float64 // probability of cutting a line short
+	corruptDirection string  // which direction garbleLines and truncateLines apply to: both, upstream or downstream
+
+	blackholeAbove     int    // chunks larger than this many bytes are dropped, 0 to disable
+	blackholeDirection string // which direction blackholeAbove applies to: both, upstream or downstream
+
+	applyChanges string // which connections runtime changes of the throughput apply to: all or new
+
+	standby   bool // wait for the listen address to become available instead of failing, see listen
+	reusePort bool // share the listen address with other processes
+
+	interactive bool     // accept commands on stdin, see readCommands
+	adminListen string   // address of the admin API, see serveAdmin
+	auditLog    string   // file recording the changes made at runtime, see auditLog
+	echoListen  string   // address of the built-in echo upstream for measuring the conditions, see handle
+	live        controls // conditions that can be changed at runtime, initialised from the settings above
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+	var cfg config
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	var opts flagValues
+	defineFlags(flag.CommandLine, &cfg, &opts)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		printUsageAndExit(err.Error())
+	}
+	args := flag.Args()
+	var fileArgs configArgs
+	commandLine := map[string]bool{}
+	if opts.configFile != "" {
+		flag.Visit(func(f *flag.Flag) {
+			commandLine[f.Name] = true
+		})
+		if len(args) > 0 {
+			commandLine["throughput"] = true
+		}
+		var err error
+		if fileArgs, err = applyConfigFile(flag.CommandLine, opts.configFile, commandLine); err != nil {
+			printUsageAndExit(err.Error())
+		}
+	}
+	var forwardReplacements int
+	for _, set := range []bool{cfg.forwardExec != "", cfg.forwardBuiltin != "", cfg.socks5} {
+		if set {
+			forwardReplacements++
+		}
+	}
+	if forwardReplacements > 1 {
+		printUsageAndExit("-forward-exec, -forward-builtin and -socks5 are mutually exclusive")
+	}
+	withoutForward := forwardReplacements > 0
+	profiled := cfg.profile != "" || len(cfg.profileMix.names) > 0
+	if opts.configFile != "" && len(args) == 0 {
+		var err error
+		if args, err = fileArgs.arguments(withoutForward, profiled); err != nil {
+			printUsageAndExit(err.Error())
+		}
+	}
+	if profiled {
+		// the profiles provide the throughput unless THROUGHPUT is given
+		if withoutForward && len(args) == 1 || !withoutForward && len(args) == 2 {
+			args = append(args, "")
+		}
+	}
+	if withoutForward {
+		// the command, built-in upstream or SOCKS5 destinations take the place of the forward address
+		if len(args) != 2 {
+			printUsageAndExit("expected exactly 2 arguments with -forward-exec, -forward-builtin or -socks5")
+		}
+		args = []string{args[0], "", args[1]}
+	}
+	if len(args) != 3 {
+		printUsageAndExit("expected exactly 3 arguments")
+	}
+
+	cfg.listen = args[0]
+	cfg.forward = args[1]
+	var err error
+	if args[2] != "" {
+		cfg.throughput, err = parseThroughput(args[2])
+		if err != nil {
+			printUsageAndExit(err.Error())
+		}
+		if cfg.throughput <= 0 {
+			printUsageAndExit("THROUGHPUT must be at least 1 byte per second")
+		}
+	}
+	if cfg.profile != "" {
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if err := applyProfile(&cfg, cfg.profile, set); err != nil {
+			printUsageAndExit(err.Error())
+		}
+	}
+	if cfg.throughput == 0 {
+		// with -profile-mix only, sized for the fastest profile
+		cfg.upThroughput, cfg.downThroughput = cfg.profileMix.maxThroughput()
+		cfg.throughput = max(cfg.upThroughput, cfg.downThroughput)
+	}
+	if cfg.upThroughput == 0 {
+		cfg.upThroughput = cfg.throughput
+	}
+	if cfg.downThroughput == 0 {
+		cfg.downThroughput = cfg.throughput
+	}
+	cfg.live.setThroughput(cfg.upThroughput, cfg.downThroughput)
+	cfg.live.setLatency(cfg.latency, cfg.jitter)
+
+	if len(cfg.listenRoutes) > 0 && (cfg.proto != "tcp" || cfg.forwardExec != "" || cfg.forwardBuiltin != "" ||
+		cfg.socks5) {
+		printUsageAndExit("-route cannot be used with -proto udp or http, -forward-exec, -forward-builtin or -socks5")
+	}
+	if len(cfg.profileMix.names) > 0 && cfg.proto != "tcp" {
+		printUsageAndExit("-profile-mix cannot be used with -proto udp or http")
+	}
+	for listen := range cfg.noSniff {
+		if _, routed := cfg.listenRoutes[listen]; listen != cfg.listen && !routed {
+			printUsageAndExit(fmt.Sprintf("-no-sniff %s is neither LISTEN nor the address of a -route", listen))
+		}
+	}
+	if cfg.noSniff[cfg.listen] && (len(cfg.sniRoutes) > 0 || len(cfg.tenants) > 0) {
+		printUsageAndExit("-no-sniff cannot be given LISTEN with -sni-route or -tenant, which route by what the " +
+			"clients send")
+	}
+	if cfg.interactive && cfg.listen == "-" {
+		printUsageAndExit("-interactive cannot be used when tunnelling stdin/stdout")
+	}
+	switch cfg.proto {
+	case "tcp":
+	case "udp":
+		if cfg.forwardExec != "" || cfg.forwardBuiltin != "" || cfg.listen == "-" {
+			printUsageAndExit("-proto udp requires LISTEN and FORWARD addresses")
+		}
+		listenNetwork, _ := splitAddress(cfg.listen)
+		forwardNetwork, _ := splitAddress(cfg.forward)
+		if listenNetwork != "tcp" || forwardNetwork != "tcp" {
+			printUsageAndExit("-proto udp requires UDP addresses")
+		}
+		if cfg.hopIn || cfg.hopOut || cfg.standby || cfg.reusePort {
+			printUsageAndExit("-hop-in, -hop-out, -standby and -reuse-port cannot be used with -proto udp")
+		}
+		if cfg.udpIdleTimeout <= 0 {
+			printUsageAndExit("-udp-idle-timeout must be positive")
+		}
+		rejectConnectionFlags(cfg.proto)
+	case "http":
+		if cfg.forwardExec != "" || cfg.forwardBuiltin != "" || cfg.socks5 || cfg.listen == "-" {
+			printUsageAndExit("-proto http requires LISTEN and FORWARD addresses")
+		}
+		if cfg.hopIn || cfg.hopOut || len(cfg.sniRoutes) > 0 || len(cfg.tenants) > 0 || cfg.echoListen != "" {
+			printUsageAndExit("-hop-in, -hop-out, -sni-route, -tenant and -echo-listen cannot be used with -proto http")
+		}
+		rejectConnectionFlags(cfg.proto, "blackhole-above", "blackhole-direction", "proxy-protocol-out")
+	default:
+		printUsageAndExit(fmt.Sprintf("unknown protocol %s", cfg.proto))
+	}
+	if len(cfg.httpRoutes) > 0 && cfg.proto != "http" {
+		printUsageAndExit("-http-route requires -proto http")
+	}
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		printUsageAndExit("-tls-cert and -tls-key must be given together")
+	}
+	if cfg.tlsClientCA != "" && cfg.tlsCert == "" {
+		printUsageAndExit("-tls-client-ca requires -tls-cert")
+	}
+	if cfg.tlsCert != "" && (cfg.listen == "-" || cfg.proto == "udp") {
+		printUsageAndExit("-tls-cert requires a TCP address or Unix domain socket to listen on")
+	}
+	if opts.upstreamTLS {
+		if cfg.forwardExec != "" || cfg.forwardBuiltin != "" || cfg.proto == "udp" {
+			printUsageAndExit("-upstream-tls requires a TCP address or Unix domain socket to forward to")
+		}
+		cfg.upstreamTLS, err = newUpstreamTLSConfig(cfg.forward, opts.upstreamServerName, opts.upstreamCA,
+			opts.upstreamInsecure)
+		if err != nil {
+			printUsageAndExit(err.Error())
+		}
+	} else if opts.upstreamCA != "" || opts.upstreamServerName != "" || opts.upstreamInsecure {
+		printUsageAndExit("-upstream-ca, -upstream-servername and -upstream-insecure require -upstream-tls")
+	}
+	switch cfg.proxyProtocolOut {
+	case "", "v1", "v2":
+	default:
+		printUsageAndExit(fmt.Sprintf("unknown PROXY protocol version %s, expected v1 or v2", cfg.proxyProtocolOut))
+	}
+	switch cfg.proxyProtocolIn {
+	case "", "strip", "pass":
+	default:
+		printUsageAndExit(fmt.Sprintf("unknown -proxy-protocol-in %s, expected strip or pass", cfg.proxyProtocolIn))
+	}
+	if cfg.proxyProtocolIn != "" && (cfg.proto == "udp" || cfg.listen == "-") {
+		printUsageAndExit("-proxy-protocol-in requires a TCP address or Unix domain socket to listen on")
+	}
+	if cfg.proxyProtocolIn == "pass" && (cfg.proxyProtocolOut != "" || cfg.proto == "http") {
+		printUsageAndExit("-proxy-protocol-in pass cannot be used with -proxy-protocol-out or -proto http")
+	}
+	if (cfg.proxyProtocolOut != "" || cfg.proxyProtocolIn == "pass") &&
+		(cfg.forwardExec != "" || cfg.forwardBuiltin != "") {
+		printUsageAndExit("-proxy-protocol-out and -proxy-protocol-in pass require an address to forward to")
+	}
+	if cfg.socks5 {
+		if cfg.proto == "udp" || cfg.listen == "-" {
+			printUsageAndExit("-socks5 requires a TCP address or Unix domain socket to listen on")
+		}
+		if cfg.upstreamTLS != nil || cfg.hopOut || cfg.bypassLoopback || len(cfg.sniRoutes) > 0 ||
+			len(cfg.tenants) > 0 {
+			printUsageAndExit("-socks5 cannot be used with -upstream-tls, -hop-out, -bypass-loopback, -sni-route or " +
+				"-tenant")
+		}
+	}
+	if len(cfg.sniRoutes) > 0 || len(cfg.tenants) > 0 {
+		if cfg.forwardExec != "" || cfg.forwardBuiltin != "" || cfg.proto == "udp" || cfg.listen == "-" {
+			printUsageAndExit("-sni-route and -tenant require TCP addresses or Unix domain sockets to listen on and " +
+				"forward to")
+		}
+		if cfg.upstreamTLS != nil {
+			printUsageAndExit("-sni-route and -tenant cannot be used with -upstream-tls")
+		}
+		if len(cfg.sniRoutes) > 0 && len(cfg.tenants) > 0 {
+			printUsageAndExit("-sni-route and -tenant cannot be used together")
+		}
+	}
+	if cfg.echoListen != "" && cfg.listen == "-" {
+		printUsageAndExit("-echo-listen cannot be used when tunnelling stdin/stdout")
+	}
+	if cfg.forwardBuiltin != "" {
+		if _, err := newBuiltin(cfg.forwardBuiltin, cfg.chargenRate); err != nil {
+			printUsageAndExit(err.Error())
+		}
+	}
+	for _, direction := range []string{cfg.corruptDirection, cfg.blackholeDirection} {
+		switch direction {
+		case "both", "upstream", "downstream":
+		default:
+			printUsageAndExit(fmt.Sprintf("unknown direction %s", direction))
+		}
+	}
+	if cfg.garbleLines < 0 || cfg.garbleLines > 1 {
+		printUsageAndExit("-garble-lines must be between 0 and 1")
+	}
+	if cfg.truncateLines < 0 || cfg.truncateLines > 1 {
+		printUsageAndExit("-truncate-lines must be between 0 and 1")
+	}
+	if cfg.blackholeAbove < 0 {
+		printUsageAndExit("-blackhole-above must not be negative")
+	}
+	if cfg.applyChanges != "all" && cfg.applyChanges != "new" {
+		printUsageAndExit(fmt.Sprintf("unknown value %s for -apply-changes", cfg.applyChanges))
+	}
+	if cfg.killWith != "rst" && cfg.killWith != "fin" {
+		printUsageAndExit(fmt.Sprintf("unknown value %s for -kill-with", cfg.killWith))
+	}
+	if cfg.migratePolicy != "buffer" && cfg.migratePolicy != "drop" {
+		printUsageAndExit(fmt.Sprintf("unknown migrate policy %s", cfg.migratePolicy))
+	}
+	if cfg.reconnect < 0 || cfg.reconnectReplay < 0 {
+		printUsageAndExit("-reconnect and -reconnect-replay must not be negative")
+	}
+	if cfg.reconnectReplay > 0 && cfg.reconnect == 0 {
+		printUsageAndExit("-reconnect-replay requires -reconnect")
+	}
+	if err := pacer.CheckFraming(cfg.framing); err != nil {
+		printUsageAndExit(err.Error())
+	}
+	if err := pacer.CheckJitterDist(cfg.jitterDist); err != nil {
+		printUsageAndExit(err.Error())
+	}
+	if opts.schedule != "" {
+		if cfg.schedule, err = parseSchedule(opts.schedule); err != nil {
+			printUsageAndExit(err.Error())
+		}
+	}
+	switch cfg.windowClampLeg {
+	case "both", "client", "upstream":
+	default:
+		printUsageAndExit(fmt.Sprintf("unknown leg %s for -window-clamp-leg", cfg.windowClampLeg))
+	}
+	if cfg.windowClamp < 0 {
+		printUsageAndExit("-window-clamp must be 0 or a size in bytes")
+	}
+	if cfg.windowClamp > 0 && runtime.GOOS != "linux" {
+		printUsageAndExit("-window-clamp is only supported on Linux")
+	}
+	if cfg.socketBuffer < -1 {
+		printUsageAndExit("-socket-buffer must be -1, 0 or a size in bytes")
+	}
+	if cfg.sampleRate < 0 || cfg.sampleRate > 1 {
+		printUsageAndExit("-sample-rate must be between 0 and 1")
+	}
+	// bypassed connections are forwarded as they come, without reading anything to route them by
+	if cfg.bypassLoopback && (cfg.hopIn || cfg.hopOut || len(cfg.sniRoutes) > 0 || len(cfg.tenants) > 0) {
+		printUsageAndExit("-bypass-loopback cannot be used with -hop-in, -hop-out, -sni-route or -tenant")
+	}
+	if network, _ := splitAddress(cfg.listen); cfg.reusePort && network != "tcp" {
+		printUsageAndExit("-reuse-port requires a TCP address to listen on")
+	}
+	if cfg.standby && cfg.reusePort {
+		printUsageAndExit("-standby and -reuse-port are mutually exclusive")
+	}
+	if cfg.auditLog != "" && !cfg.interactive && cfg.adminListen == "" && opts.configFile == "" {
+		printUsageAndExit("-audit-log requires -interactive, -admin or -config")
+	}
+	if cfg.quota > 0 && cfg.ledgerPath == "" {
+		printUsageAndExit("-quota requires -ledger")
+	}
+	switch cfg.quotaAction {
+	case "block":
+	case "throttle":
+		if cfg.quotaThroughput <= 0 || cfg.quotaThroughput > max(cfg.upThroughput, cfg.downThroughput) {
+			printUsageAndExit("-quota-action throttle requires a -quota-throughput between 1 and THROUGHPUT")
+		}
+	default:
+		printUsageAndExit(fmt.Sprintf("unknown quota action %s", cfg.quotaAction))
+	}
+
+	if opts.idleStallMax > 0 && cfg.idleStall == 0 {
+		printUsageAndExit("-idle-stall-max requires -idle-stall")
+	}
+	cfg.idleStallMax = uint32(opts.idleStallMax)
+	if cfg.logFormat != "text" && cfg.logFormat != "json" {
+		printUsageAndExit(fmt.Sprintf("unknown log format %s", cfg.logFormat))
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if cfg.logFile != "" {
+		logFile, err := openRotatingFile(cfg.logFile, cfg.logMaxSize, cfg.logMaxAge, cfg.logKeep)
+		if err != nil {
+			log.Fatalf("log file: %v", err)
+		}
+		logOutput = logFile
+	}
+	if cfg.logFormat == "json" {
+		useJSONLog(logOutput)
+	} else {
+		log.SetOutput(logOutput)
+	}
+
+	if cfg.maxProcs > 0 {
+		runtime.GOMAXPROCS(cfg.maxProcs)
+	}
+	if cfg.maxMemory > 0 {
+		// collect garbage more aggressively when getting close to the limit before shedding load
+		debug.SetMemoryLimit(cfg.maxMemory)
+	}
+	if err := checkFileLimit(cfg.maxConns); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+
+	var usage *ledger
+	if cfg.ledgerPath != "" {
+		usage, err = loadLedger(cfg.ledgerPath)
+		if err != nil {
+			log.Fatalf("ledger: %v", err)
+		}
+		go usage.saveEvery(ledgerSaveInterval)
+	}
+
+	px := newProxy(&cfg, usage)
+
+	if cfg.schedule != nil {
+		go runSchedule(&cfg, px.conns, time.Now())
+	}
+
+	if cfg.influxURL != "" {
+		go px.exportInflux()
+	}
+	if cfg.lingerAlarm > 0 && cfg.proto != "udp" {
+		go px.watchLingering()
+	}
+
+	if cfg.statusListen != "" {
+		statusListener, err := net.Listen("tcp", cfg.statusListen)
+		if err != nil {
+			log.Fatalf("status: %v", err)
+		}
+		go px.serveStatus(statusListener)
+	}
+
+	var audit *auditLog
+	if cfg.auditLog != "" {
+		audit, err = openAuditLog(cfg.auditLog)
+		if err != nil {
+			log.Fatalf("audit log: %v", err)
+		}
+	}
+
+	if cfg.adminListen != "" {
+		adminListener, err := net.Listen("tcp", cfg.adminListen)
+		if err != nil {
+			log.Fatalf("admin: %v", err)
+		}
+		go px.serveAdmin(adminListener, audit)
+	}
+
+	if cfg.listen == "-" {
+		// tunnel mode: the only connection is stdin/stdout and the process ends with it
+		px.handle(stdioConn{}, cfg.listen, "", nil)
+		return
+	}
+
+	if opts.configFile != "" {
+		go px.reloadOnHangup(opts.configFile, commandLine, audit)
+	}
+
+	var shuttingDown uint32
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, os.Kill)
+
+	var listeners []io.Closer
+	var httpServer *http.Server
+	if cfg.proto == "udp" {
+		packetConn, err := net.ListenPacket("udp", cfg.listen)
+		if err != nil {
+			log.Fatalf("listen: %v", err)
+		}
+		listeners = append(listeners, packetConn)
+		go px.serveUDP(packetConn)
+	} else {
+		tcpListener, err := openListener(&cfg, cfg.listen)
+		if err != nil {
+			log.Fatalf("listen: %v", err)
+		}
+		if cfg.proto == "http" {
+			// the server closes the listener itself when it is drained
+			httpServer = px.httpServer()
+			go serveHTTP(httpServer, tcpListener)
+		} else {
+			listeners = append(listeners, tcpListener)
+			go px.serve(tcpListener, cfg.listen, &shuttingDown, "", nil)
+		}
+	}
+	for listen, r := range cfg.listenRoutes {
+		routeListener, err := openListener(&cfg, listen)
+		if err != nil {
+			log.Fatalf("route: %v", err)
+		}
+		listeners = append(listeners, routeListener)
+		r := r
+		go px.serve(routeListener, listen, &shuttingDown, "", &r)
+	}
+
+	if cfg.echoListen != "" {
+		echoListener, err := net.Listen("tcp", cfg.echoListen)
+		if err != nil {
+			log.Fatalf("echo: %v", err)
+		}
+		go px.serve(echoListener, cfg.echoListen, &shuttingDown, "echo", nil)
+	}
+
+	if cfg.interactive {
+		go readCommands(os.Stdin, os.Stdout, &cfg, px.conns, audit)
+	}
+
+	<-shutdown
+	atomic.StoreUint32(&shuttingDown, 1)
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			log.Printf("close: %v", err)
+		}
+	}
+	if httpServer != nil {
+		drainHTTP(httpServer)
+	}
+	if usage != nil {
+		if err := usage.save(); err != nil {
+			log.Printf("ledger: %v", err)
+		}
+	}
+}
+
+// flagValues are the options of the proxy that are converted after parsing, unlike those kept in config as they are.
+type flagValues struct {
+	upstreamTLS, upstreamInsecure  bool
+	upstreamCA, upstreamServerName string
+	schedule                       string
+	idleStallMax                   uint
+	configFile                     string
+}
+
+// defineFlags defines the options of the proxy on fs, which set cfg and opts, and sets them to their defaults.
+func defineFlags(fs *flag.FlagSet, cfg *config, opts *flagValues) {
+	fs.StringVar(&cfg.proto, "proto", "tcp",
+		"protocol to proxy: tcp, udp to relay datagrams with a session per client address, eg. for DNS or QUIC, or "+
+			"http to reverse proxy HTTP requests and log each of them; options for TCP connections cannot be used "+
+			"with udp and http")
+	fs.DurationVar(&cfg.udpIdleTimeout, "udp-idle-timeout", time.Minute,
+		"end UDP sessions without datagrams in either direction for this long")
+	fs.Var(&cfg.httpRoutes, "http-route",
+		"apply another throughput to the requests for paths starting with PREFIX with -proto http, as "+
+			"PREFIX=THROUGHPUT repeated or separated by commas, eg. /downloads/*=100k,/api/*=0 where 0 is unlimited")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", "",
+		"terminate TLS from clients with the certificate in this PEM file and forward plaintext, requires -tls-key")
+	fs.StringVar(&cfg.tlsKey, "tls-key", "", "PEM file with the private key for -tls-cert")
+	fs.StringVar(&cfg.tlsClientCA, "tls-client-ca", "",
+		"require clients to present a certificate signed by one of the CA certificates in this PEM file with -tls-cert")
+	fs.BoolVar(&opts.upstreamTLS, "upstream-tls", false, "connect to FORWARD with TLS")
+	fs.StringVar(&opts.upstreamCA, "upstream-ca", "",
+		"verify the upstream's certificate with the CA certificates in this PEM file instead of the system's")
+	fs.StringVar(&opts.upstreamServerName, "upstream-servername", "",
+		"server name to request and verify with -upstream-tls, defaults to the host of FORWARD")
+	fs.BoolVar(&opts.upstreamInsecure, "upstream-insecure", false,
+		"do not verify the upstream's certificate with -upstream-tls, eg. for self-signed test backends")
+	fs.Var(&cfg.sniRoutes, "sni-route",
+		"forward TLS connections for the server name HOST to another address, optionally with their own throughput "+
+			"or profile, as HOST=FORWARD[@THROUGHPUT|@PROFILE] repeated or separated by commas, eg. "+
+			"api.example.com=10.0.0.1:443@1M; other connections use FORWARD")
+	fs.Var(&cfg.tenants, "tenant",
+		"expect clients to name a tenant in their first line, which is stripped, and forward them to the tenant's "+
+			"address with its own throughput or profile, as NAME=FORWARD[@THROUGHPUT|@PROFILE] repeated or separated "+
+			"by commas, eg. phone1=10.0.0.1:80@3g; an empty line selects FORWARD")
+	fs.BoolVar(&cfg.socks5, "socks5", false,
+		"act as a SOCKS5 proxy without authentication and forward to the destination each client requests instead "+
+			"of FORWARD")
+	fs.StringVar(&cfg.forwardExec, "forward-exec", "",
+		"forward to the stdin and stdout of a new process per connection running this command (split at spaces) "+
+			"instead of FORWARD")
+	fs.StringVar(&cfg.forwardBuiltin, "forward-builtin", "",
+		"forward to a built-in upstream instead of FORWARD: echo, discard or chargen")
+	fs.Var((*throughputValue)(&cfg.chargenRate), "chargen-rate",
+		"`throughput` of the chargen built-in upstream, 0 for as fast as possible")
+	fs.Var((*throughputValue)(&cfg.upThroughput), "up",
+		"`throughput` from the client to the upstream instead of THROUGHPUT, eg. 128k for an asymmetric link")
+	fs.Var((*throughputValue)(&cfg.downThroughput), "down",
+		"`throughput` from the upstream to the client instead of THROUGHPUT, eg. 1M for an asymmetric link")
+	fs.StringVar(&cfg.profile, "profile", "",
+		"use the throughput, latency and jitter of a typical network unless given explicitly: "+
+			strings.Join(profileNames(), ", "))
+	fs.Var(&cfg.listenRoutes, "route",
+		"also listen on LISTEN and forward its connections to FORWARD, with their own throughput or profile if "+
+			"given, as LISTEN=FORWARD[@THROUGHPUT|@PROFILE] repeated or separated by commas, eg. "+
+			"localhost:5433=db:5432@1M,localhost:6380=cache:6379@3g")
+	fs.Var(&cfg.profileMix, "profile-mix",
+		"give each connection a profile drawn at random by weight, as PROFILE=WEIGHT repeated or separated by "+
+			"commas, eg. 4g=60,3g=30,2g-edge=10; connections of routes with their own throughput or profile keep it")
+	fs.StringVar(&opts.schedule, "schedule", "",
+		"change the throughput in both directions over time, eg. 0s=1M,30s=128k,60s=1M for a dip after 30s")
+	fs.BoolVar(&cfg.shared, "shared", false,
+		"share THROUGHPUT (or -up and -down) among all connections instead of applying it to each of them")
+	fs.IntVar(&cfg.bdp, "bdp", 0,
+		"limit the bytes in flight inside the proxy per direction to this bandwidth-delay product, eg. 65536")
+	fs.IntVar(&cfg.socketBuffer, "socket-buffer", -1,
+		"size of the socket send and receive buffers in bytes, -1 to match the copy buffers, "+
+			"0 to leave them to the kernel's autotuning")
+	fs.Int64Var(&cfg.unthrottled, "unthrottled-bytes", 0,
+		"forward this many bytes at the start of each direction unthrottled, "+
+			"eg. 16384 to keep TLS handshakes out of throughput measurements")
+	fs.BoolVar(&cfg.coalesce, "coalesce", false,
+		"let the kernel coalesce small writes to the upstream (Nagle's algorithm) instead of sending each read "+
+			"on as is")
+	fs.IntVar(&cfg.windowClamp, "window-clamp", 0,
+		"clamp the TCP receive window advertised on -window-clamp-leg to this many bytes (Linux only), "+
+			"to compare flow control limited transfers with paced ones, eg. 16384")
+	fs.StringVar(&cfg.windowClampLeg, "window-clamp-leg", "both",
+		"leg -window-clamp applies to: both, client to hold back what the client sends, "+
+			"or upstream to hold back what the upstream sends")
+	fs.BoolVar(&cfg.bypassLoopback, "bypass-loopback", false,
+		"forward connections from loopback addresses, eg. local health probes, without any conditions and leave "+
+			"them out of the connection counts")
+	fs.IntVar(&cfg.maxConns, "max-conns", 0, "reject connections beyond this many open ones, 0 for no limit")
+	fs.Int64Var(&cfg.maxMemory, "max-memory", 0,
+		"reject connections while the proxy uses more than this many bytes of memory, 0 for no limit")
+	fs.IntVar(&cfg.maxProcs, "max-procs", 0, "use at most this many CPUs, 0 for all")
+	fs.BoolVar(&cfg.hopIn, "hop-in", false, "expect hop metadata from a downstream slowproxy started with -hop-out")
+	fs.BoolVar(&cfg.hopOut, "hop-out", false, "send hop metadata to an upstream slowproxy started with -hop-in")
+	fs.StringVar(&cfg.proxyProtocolOut, "proxy-protocol-out", "",
+		"send a PROXY protocol header with the client's address to the upstream, v1 or v2, eg. for HAProxy, nginx "+
+			"or PostgreSQL behind the proxy")
+	fs.StringVar(&cfg.proxyProtocolIn, "proxy-protocol-in", "",
+		"expect a PROXY protocol header from a load balancer in front of the proxy and use the client's address in "+
+			"it, then strip it or pass it to the upstream as received")
+	fs.StringVar(&cfg.anonymizeSalt, "anonymize-salt", "",
+		"replace client IP addresses in logs with a hash salted with this value")
+	fs.DurationVar(&cfg.closeDelay, "close-delay", 0,
+		"delay passing on the upstream's close to the client after all data has been forwarded, eg. 30s")
+	fs.DurationVar(&cfg.lingerAlarm, "linger-alarm", 5*time.Minute,
+		"warn about connections still open this long after one side closed, on top of -close-delay, as they may "+
+			"be leaking; 0 to disable")
+	fs.BoolVar(&cfg.labelHTTP, "label-http", false,
+		"label connections in logs and statistics with their first HTTP request line, eg. GET /index.html")
+	fs.Var(&cfg.noSniff, "no-sniff",
+		"forward the connections to these listen addresses, LISTEN or those of -route, repeated or separated by "+
+			"commas, without looking at what the clients send, eg. for VPNs over TCP or TLS within SOCKS: no "+
+			"-label-http, -sni-route or -tenant")
+	fs.IntVar(&cfg.upstreamReadSize, "upstream-read-size", 0,
+		"read at most this many bytes at a time from the upstream, to emulate a slow reader together with "+
+			"-upstream-read-gap")
+	fs.DurationVar(&cfg.upstreamReadGap, "upstream-read-gap", 0,
+		"pause between reads from the upstream regardless of the throughput towards the client, eg. 100ms")
+	fs.DurationVar(&cfg.latency, "latency", 0,
+		"delay every chunk by this much in each direction, so the round-trip time grows by twice as much, eg. 40ms")
+	fs.DurationVar(&cfg.jitter, "jitter", 0, "vary the -latency of each chunk randomly by this much, eg. 10ms")
+	fs.StringVar(&cfg.jitterDist, "jitter-dist", "uniform",
+		"distribution of -jitter: uniform within ±jitter, normal with jitter as the standard deviation, "+
+			"or pareto for additional delays with a long tail")
+	fs.StringVar(&cfg.ledgerPath, "ledger", "",
+		"keep the bytes transferred per client IP address in this file so they survive restarts")
+	fs.Int64Var(&cfg.quota, "quota", 0,
+		"bytes per client IP address after which -quota-action applies, requires -ledger")
+	fs.StringVar(&cfg.quotaAction, "quota-action", "block",
+		"what happens once a client exceeds its quota: block or throttle")
+	fs.Var((*throughputValue)(&cfg.quotaThroughput), "quota-throughput",
+		"`throughput` for clients over quota with -quota-action throttle")
+	fs.StringVar(&cfg.logFile, "log-file", "", "log to this file instead of stderr")
+	fs.StringVar(&cfg.logFormat, "log-format", "text",
+		"format of the log: text, or json for one object per line with structured fields for connection events")
+	fs.Int64Var(&cfg.logMaxSize, "log-max-size", 100<<20,
+		"rotate the log file once it exceeds this size in bytes, 0 to disable")
+	fs.DurationVar(&cfg.logMaxAge, "log-max-age", 0, "rotate the log file once it is older than this, eg. 24h")
+	fs.IntVar(&cfg.logKeep, "log-keep", 10, "number of compressed rotated log files to keep")
+	fs.DurationVar(&cfg.idleReset, "idle-reset", 0,
+		"send a RST to both sides of connections that have been idle for this long, like firewalls and NATs "+
+			"expiring idle flows")
+	fs.DurationVar(&cfg.idleStall, "idle-stall", 0,
+		"stall the first transfer after a connection has been idle for this long by -idle-stall-for")
+	fs.DurationVar(&cfg.idleStallFor, "idle-stall-for", 5*time.Second,
+		"how long to stall the first transfer after -idle-stall")
+	fs.UintVar(&opts.idleStallMax, "idle-stall-max", 0,
+		"reset connections after stalling them this many times with -idle-stall, like a sender giving up after "+
+			"its maximum retransmissions, 0 for no limit")
+	fs.Float64Var(&cfg.killRate, "kill-rate", 0,
+		"kill connections at random at this rate per second and connection, eg. 0.01 for a mean lifetime of 100s")
+	fs.StringVar(&cfg.killWith, "kill-with", "rst",
+		"how -kill-rate kills connections: rst to reset them or fin to close them")
+	fs.DurationVar(&cfg.migrateEvery, "migrate-every", 0,
+		"tear down and re-establish the upstream connection this often while keeping the client connection open")
+	fs.DurationVar(&cfg.migrateGap, "migrate-gap", time.Second,
+		"time without an upstream connection during -migrate-every")
+	fs.StringVar(&cfg.migratePolicy, "migrate-policy", "buffer",
+		"what happens to data the client sends during the -migrate-gap: buffer or drop")
+	fs.DurationVar(&cfg.reconnect, "reconnect", 0,
+		"when the upstream connection fails or is reset while the client is still connected, redial the upstream for "+
+			"up to this long and resume forwarding instead of closing the client connection, eg. 30s to survive "+
+			"backend restarts; an upstream closing cleanly is passed on")
+	fs.IntVar(&cfg.reconnectReplay, "reconnect-replay", 0,
+		"send the last this many bytes the client sent again to a reconnected upstream with -reconnect, eg. to repeat "+
+			"a subscription")
+	fs.Float64Var(&cfg.messageRate, "message-rate", 0,
+		"limit the messages forwarded per second in each direction, with messages delimited according to -framing")
+	fs.StringVar(&cfg.framing, "framing", "line",
+		"how messages are delimited for -message-rate: line, or len16/len32 for a big-endian length prefix")
+	fs.StringVar(&cfg.influxURL, "influx-url", "",
+		"write per-connection throughput samples in line protocol to this InfluxDB write endpoint, "+
+			"eg. http://localhost:8086/api/v2/write?org=lab&bucket=slowproxy")
+	fs.StringVar(&cfg.influxToken, "influx-token", "", "API token for -influx-url")
+	fs.DurationVar(&cfg.influxInterval, "influx-interval", 10*time.Second, "sampling window for -influx-url")
+	fs.Float64Var(&cfg.sampleRate, "sample-rate", 1,
+		"fraction of connections to write per-connection samples for with -influx-url, eg. 0.01 for high volumes")
+	fs.StringVar(&cfg.echoListen, "echo-listen", "",
+		"also accept connections to a built-in echo upstream on this address under the same conditions, "+
+			"so test harnesses can measure the latency currently applied, eg. localhost:8082")
+	fs.StringVar(&cfg.statusListen, "status-listen", "",
+		"serve a read-only status page with the configuration and aggregate statistics on this address, "+
+			"eg. :8081")
+	fs.Float64Var(&cfg.garbleLines, "garble-lines", 0,
+		"probability of inserting a garbage line before a line of a line-based protocol, eg. 0.01")
+	fs.Float64Var(&cfg.truncateLines, "truncate-lines", 0,
+		"probability of cutting a line of a line-based protocol short")
+	fs.StringVar(&cfg.corruptDirection, "corrupt-direction", "both",
+		"direction -garble-lines and -truncate-lines apply to: both, upstream or downstream")
+	fs.IntVar(&cfg.blackholeAbove, "blackhole-above", 0,
+		"stall TCP after a chunk larger than this many bytes and silently drop larger datagrams, like a path MTU "+
+			"blackhole, eg. 1400")
+	fs.StringVar(&cfg.blackholeDirection, "blackhole-direction", "both",
+		"direction -blackhole-above applies to: both, upstream or downstream")
+	fs.StringVar(&cfg.applyChanges, "apply-changes", "all",
+		"which connections throughput changes at runtime apply to: all, or new to keep open connections unchanged")
+	fs.BoolVar(&cfg.standby, "standby", false,
+		"run as a standby that takes over LISTEN once it becomes available, eg. when the active instance dies")
+	fs.BoolVar(&cfg.reusePort, "reuse-port", false,
+		"set SO_REUSEPORT so several instances can listen on the same address and share its connections")
+	fs.BoolVar(&cfg.interactive, "interactive", false,
+		"accept commands on stdin to change the throughput or pause transfers while running")
+	fs.StringVar(&cfg.adminListen, "admin", "",
+		"serve an HTTP API to change the conditions and list the connections while running on this address, "+
+			"eg. localhost:9090")
+	fs.StringVar(&cfg.auditLog, "audit-log", "",
+		"record the changes made while running, with the time and user, in this file")
+	fs.StringVar(&opts.configFile, "config", "",
+		"read options and LISTEN, FORWARD and THROUGHPUT from this YAML file, see the README, with the command line "+
+			"taking precedence; on SIGHUP the throughput, latency and jitter are read from it again")
+}
+
+// connectionFlags are the options that only apply to the TCP connections of -proto tcp, see rejectConnectionFlags.
+var connectionFlags = map[string]bool{
+	"apply-changes": true, "bdp": true, "bypass-loopback": true, "close-delay": true, "coalesce": true,
+	"corrupt-direction": true, "framing": true, "garble-lines": true, "idle-reset": true, "idle-stall": true,
+	"idle-stall-for": true, "idle-stall-max": true, "kill-rate": true, "kill-with": true, "label-http": true,
+	"ledger": true, "linger-alarm": true, "message-rate": true, "migrate-every": true, "migrate-gap": true,
+	"migrate-policy": true, "no-sniff": true, "quota": true, "quota-action": true, "quota-throughput": true,
+	"reconnect": true, "reconnect-replay": true, "sample-rate": true, "socket-buffer": true, "truncate-lines": true,
+	"unthrottled-bytes": true, "upstream-read-gap": true, "upstream-read-size": true, "window-clamp": true,
+	"window-clamp-leg": true,
+}
+
+// rejectConnectionFlags exits with the usage if any of connectionFlags or the other options is set, from the command
+// line or the config file, together with proto, which does not relay TCP connections.
+func rejectConnectionFlags(proto string, other ...string) {
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		if connectionFlags[f.Name] || slices.Contains(other, f.Name) {
+			set = append(set, "-"+f.Name)
+		}
+	})
+	if len(set) > 0 {
+		printUsageAndExit(fmt.Sprintf("%s cannot be used with -proto %s", strings.Join(set, ", "), proto))
+	}
+}
+
+func printUsageAndExit(msg string) {
+	var options bytes.Buffer
+	flag.CommandLine.SetOutput(&options)
+	flag.PrintDefaults()
+
+	log.Fatalf(`Usage: %[1]s [OPTIONS] LISTEN FORWARD THROUGHPUT
+       %[1]s [OPTIONS] -forward-exec COMMAND LISTEN THROUGHPUT
+       %[1]s [OPTIONS] -forward-builtin echo|discard|chargen LISTEN THROUGHPUT
+       %[1]s [OPTIONS] -socks5 LISTEN THROUGHPUT
+       %[1]s [OPTIONS] -profile PROFILE LISTEN FORWARD [THROUGHPUT]
+       %[1]s verify [-throughput THROUGHPUT] [-latency LATENCY] [-duration DURATION] [-tolerance PERCENT]
+
+  LISTEN      The listen address, eg. localhost:8080, unix:/tmp/app.sock or \\.\pipe\app, or - to tunnel stdin/stdout
+  FORWARD     The forward address, eg. localhost:80, unix:/var/run/app.sock or \\.\pipe\app
+  THROUGHPUT  Maximum throughput in bytes per second, eg. 65536, 512k, 100KB/s or in bits per second, eg. 1.5Mbit
+
+Options:
+%[2]s
+Error: %[3]s`, os.Args[0], options.String(), msg)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// serveMetrics exports the proxy's statistics in the Prometheus text format, so load tests can graph them. Counters
+// cover all connections since the proxy started, including the open ones.
+func (px *proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("slowproxy_connections_active", "gauge", "Connections being proxied.")
+	fmt.Fprintf(&out, "slowproxy_connections_active %d\n", len(px.conns.open()))
+	metric("slowproxy_connections_accepted_total", "counter", "Connections accepted from clients.")
+	fmt.Fprintf(&out, "slowproxy_connections_accepted_total %d\n", atomic.LoadUint64(&px.accepted))
+	metric("slowproxy_connections_closed_total", "counter", "Connections closed, by the reason they ended for.")
+	writeCounts(&out, "slowproxy_connections_closed_total", "reason", px.conns.reasons.snapshot())
+	metric("slowproxy_accept_errors_total", "counter", "Errors accepting connections, by class.")
+	writeCounts(&out, "slowproxy_accept_errors_total", "class", px.acceptErrors.snapshot())
+	metric("slowproxy_dial_errors_total", "counter", "Errors dialing the upstream, by class.")
+	writeCounts(&out, "slowproxy_dial_errors_total", "class", px.dialErrors.snapshot())
+
+	metric("slowproxy_teardown_seconds", "histogram",
+		"Time from the first side closing to the pair being torn down, by the reason the connection ended for.")
+	teardowns := px.conns.teardowns.snapshot()
+	reasons := make([]string, 0, len(teardowns))
+	for reason := range teardowns {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		var cumulative uint64
+		for i, n := range teardowns[reason] {
+			cumulative += n
+			fmt.Fprintf(&out, "slowproxy_teardown_seconds_bucket{reason=%q,le=%q} %d\n", reason,
+				px.conns.teardowns.bucketLabel(i), cumulative)
+		}
+		fmt.Fprintf(&out, "slowproxy_teardown_seconds_sum{reason=%q} %g\n", reason, px.conns.teardowns.sum(reason))
+		fmt.Fprintf(&out, "slowproxy_teardown_seconds_count{reason=%q} %d\n", reason, cumulative)
+	}
+	metric("slowproxy_throughput_bytes", "histogram",
+		"Throughput achieved by closed connections in bytes per second, by listener and direction.")
+	throughputs := px.conns.throughputs.snapshot()
+	for _, key := range sortedThroughputKeys(throughputs) {
+		var cumulative uint64
+		for i, n := range throughputs[key] {
+			cumulative += n
+			fmt.Fprintf(&out, "slowproxy_throughput_bytes_bucket{listener=%q,direction=%q,le=%q} %d\n", key.listener,
+				key.direction, px.conns.throughputs.bucketLabel(i), cumulative)
+		}
+		fmt.Fprintf(&out, "slowproxy_throughput_bytes_sum{listener=%q,direction=%q} %g\n", key.listener, key.direction,
+			px.conns.throughputs.sum(key))
+		fmt.Fprintf(&out, "slowproxy_throughput_bytes_count{listener=%q,direction=%q} %d\n", key.listener,
+			key.direction, cumulative)
+	}
+	metric("slowproxy_connections_lingering", "gauge",
+		"Connections still open longer than -linger-alarm after one side closed.")
+	fmt.Fprintf(&out, "slowproxy_connections_lingering %d\n", len(px.lingering()))
+
+	totals := px.conns.totals()
+	metric("slowproxy_transferred_bytes_total", "counter", "Bytes forwarded, by direction.")
+	for _, direction := range []string{"upstream", "downstream"} {
+		fmt.Fprintf(&out, "slowproxy_transferred_bytes_total{direction=%q} %d\n", direction,
+			totals[direction].transferred)
+	}
+	metric("slowproxy_throttled_seconds_total", "counter", "Time spent sleeping to limit the throughput, by direction.")
+	for _, direction := range []string{"upstream", "downstream"} {
+		fmt.Fprintf(&out, "slowproxy_throttled_seconds_total{direction=%q} %g\n", direction,
+			float64(totals[direction].throttled)/1e9)
+	}
+
+	up, down := px.cfg.live.currentThroughput()
+	metric("slowproxy_throughput_limit_bytes", "gauge", "Current throughput limit in bytes per second, by direction.")
+	fmt.Fprintf(&out, "slowproxy_throughput_limit_bytes{direction=\"upstream\"} %d\n", up)
+	fmt.Fprintf(&out, "slowproxy_throughput_limit_bytes{direction=\"downstream\"} %d\n", down)
+	paused := 0
+	if px.cfg.live.isPaused() {
+		paused = 1
+	}
+	metric("slowproxy_paused", "gauge", "Whether all transfers are paused.")
+	fmt.Fprintf(&out, "slowproxy_paused %d\n", paused)
+	metric("slowproxy_clock_jumps_total", "counter",
+		"Jumps of the wall clock, eg. from suspending the host or NTP steps, after which the pacing restarted.")
+	fmt.Fprintf(&out, "slowproxy_clock_jumps_total %d\n", pacer.ClockJumps())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := out.WriteTo(w); err != nil {
+		log.Printf("metrics: %v", err)
+	}
+}
+
+// writeCounts writes a sample of the metric name per entry of counts, labelled with label, in a stable order.
+func writeCounts(out *bytes.Buffer, name, label string, counts map[string]uint64) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s{%s=%q} %d\n", name, label, key, counts[key])
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// migratingConn is an upstream endpoint that can be torn down and re-established while the client connection stays
+// open, emulating a mobile client switching networks behind a stable front connection. During the gap between two
+// upstream connections, writes either block until the new connection is available or, with drop, are discarded.
+// With -reconnect, it also replaces upstream connections that drop while the client is still connected, but not those
+// the upstream closes cleanly.
+type migratingConn struct {
+	drop bool
+
+	// redial, if not nil, re-establishes the upstream connection when it drops, for up to redialFor
+	redial    func() (endpoint, error)
+	redialFor time.Duration
+	replay    int    // size of tail
+	name      string // identifies the connection in logs
+
+	mu          sync.Mutex
+	changed     *sync.Cond
+	current     endpoint // nil during a gap
+	generation  int      // incremented by every migration
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+	tail        []byte // the last replay bytes written, sent again to a reconnected upstream
+}
+
+func newMigratingConn(conn endpoint, drop bool) *migratingConn {
+	c := &migratingConn{drop: drop, current: conn}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire returns the current connection and its generation. During a gap it waits for the next connection unless
+// wait is false, in which case it returns nil. It also returns nil once the endpoint is closed.
+func (c *migratingConn) acquire(wait bool) (endpoint, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.current == nil && !c.closed && wait {
+		c.changed.Wait()
+	}
+	if c.closed {
+		return nil, c.generation
+	}
+	return c.current, c.generation
+}
+
+// migrated reports whether a migration happened since generation, in which case an error on the old connection is
+// expected and the operation should be retried on the new one.
+func (c *migratingConn) migrated(generation int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation != generation && !c.closed
+}
+
+func (c *migratingConn) Read(p []byte) (int, error) {
+	for {
+		conn, generation := c.acquire(true)
+		if conn == nil {
+			return 0, io.EOF
+		}
+		n, err := conn.Read(p)
+		// the upstream closing cleanly is passed on to the client, only failures are reconnected
+		if err != nil && n == 0 && (c.migrated(generation) || err != io.EOF && c.reconnect(generation)) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *migratingConn) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		conn, generation := c.acquire(!c.drop)
+		if conn == nil {
+			if c.drop && !c.isClosed() {
+				return len(p), nil // the data is lost in the gap
+			}
+			return written, io.ErrClosedPipe
+		}
+		n, err := conn.Write(p[written:])
+		c.remember(p[written : written+n])
+		written += n
+		if err != nil && (c.migrated(generation) || c.reconnect(generation)) {
+			if c.drop {
+				return len(p), nil
+			}
+			continue
+		}
+		return written, err
+	}
+}
+
+// remember keeps the tail of the data written for a reconnected upstream.
+func (c *migratingConn) remember(p []byte) {
+	if c.replay == 0 || len(p) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tail = append(c.tail, p[max(0, len(p)-c.replay):]...)
+	if len(c.tail) > c.replay {
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-c.replay:]...)
+	}
+}
+
+func (c *migratingConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *migratingConn) CloseRead() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readClosed = true
+	if c.current == nil {
+		return nil
+	}
+	return c.current.CloseRead()
+}
+
+func (c *migratingConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeClosed = true
+	if c.current == nil {
+		return nil
+	}
+	return c.current.CloseWrite()
+}
+
+func (c *migratingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.changed.Broadcast()
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
+
+// migrate closes the current connection, waits for gap and replaces it with a new one from dial. If dialing fails the
+// endpoint is closed. It does nothing while the upstream is being reconnected.
+func (c *migratingConn) migrate(gap time.Duration, dial func() (endpoint, error)) error {
+	c.mu.Lock()
+	if c.closed || c.current == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	old := c.current
+	c.current = nil
+	c.generation++
+	c.mu.Unlock()
+	reset(old)
+
+	time.Sleep(gap)
+	conn, err := dial()
+	return c.install(conn, err)
+}
+
+// install makes conn, dialed during a gap, the current connection, or closes the endpoint if dialing failed.
+func (c *migratingConn) install(conn endpoint, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.changed.Broadcast()
+	if err != nil {
+		c.closed = true
+		return err
+	}
+	if c.closed {
+		return conn.Close()
+	}
+	// carry over the half-closed state of the previous connection
+	if c.readClosed {
+		conn.CloseRead()
+	}
+	if c.writeClosed {
+		conn.CloseWrite()
+	}
+	c.current = conn
+	return nil
+}
+
+// reconnect replaces the connection of generation, which failed, with one from redial, unless it has been replaced
+// already. It replays the tail of the data written to the new connection. It reports whether the failed operation
+// should be retried: the upstream is not reconnected without redial, or once the client has finished sending, as the
+// upstream closing then ends the connection as usual.
+func (c *migratingConn) reconnect(generation int) bool {
+	if c.redial == nil {
+		return false
+	}
+	c.mu.Lock()
+	if c.closed || c.writeClosed {
+		c.mu.Unlock()
+		return false
+	}
+	if c.generation != generation {
+		c.mu.Unlock()
+		return true
+	}
+	old := c.current
+	c.current = nil
+	c.generation++
+	tail := append([]byte(nil), c.tail...)
+	c.mu.Unlock()
+	reset(old)
+
+	log.Printf("%s: upstream dropped, reconnecting", c.name)
+	start := time.Now()
+	wait := 100 * time.Millisecond
+	for {
+		conn, err := c.redial()
+		if err == nil && len(tail) > 0 {
+			if _, err = conn.Write(tail); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			log.Printf("%s: upstream reconnected after %v, replayed %d bytes", c.name,
+				time.Since(start).Round(time.Millisecond), len(tail))
+			return c.install(conn, nil) == nil
+		}
+		remaining := c.redialFor - time.Since(start)
+		if remaining <= 0 || c.isClosed() {
+			log.Printf("%s: unable to reconnect upstream: %v", c.name, err)
+			c.install(nil, err)
+			return false
+		}
+		time.Sleep(min(wait, remaining))
+		wait = min(2*wait, time.Second)
+	}
+}
+
+// migrateEvery migrates the connection every interval until done is closed. The name identifies the connection in
+// logs.
+func (c *migratingConn) migrateEvery(interval, gap time.Duration, dial func() (endpoint, error), name string,
+	done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		log.Printf("%s: migrating upstream connection, gap %v", name, gap)
+		if err := c.migrate(gap, dial); err != nil {
+			log.Printf("%s: migration failed: %v", name, err)
+			return
+		}
+	}
+}
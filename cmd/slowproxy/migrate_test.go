@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// reconnectingConn returns a migratingConn with -reconnect to a listener whose connections are handed to upstream
+// one after the other, and the number of times it redialed.
+func reconnectingConn(t *testing.T, upstream func(int, *net.TCPConn)) (*migratingConn, *int) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go upstream(i, conn.(*net.TCPConn))
+		}
+	}()
+	dial := func() (endpoint, error) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redials := 0
+	c := newMigratingConn(conn, false)
+	c.redial = func() (endpoint, error) {
+		redials++
+		return dial()
+	}
+	c.redialFor, c.name = time.Second, "test"
+	t.Cleanup(func() { c.Close() })
+	return c, &redials
+}
+
+func TestReconnectPassesCleanClose(t *testing.T) {
+	c, redials := reconnectingConn(t, func(_ int, conn *net.TCPConn) {
+		conn.Write([]byte("bye"))
+		conn.CloseWrite()
+	})
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "bye" {
+		t.Errorf("read %q, %v, want bye and the end of the stream", got, err)
+	}
+	if *redials != 0 {
+		t.Errorf("redialed %d times after a clean close, want none", *redials)
+	}
+}
+
+func TestReconnectAfterReset(t *testing.T) {
+	c, redials := reconnectingConn(t, func(i int, conn *net.TCPConn) {
+		if i == 0 {
+			// wait for the client, as the connection may not have been established on its side yet
+			conn.Read(make([]byte, 1))
+			reset(conn)
+			return
+		}
+		conn.Write([]byte("again"))
+		conn.Close()
+	})
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "again" {
+		t.Errorf("read %q, %v, want again from the reconnected upstream", got, err)
+	}
+	if *redials != 1 {
+		t.Errorf("redialed %d times after a reset, want 1", *redials)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows || !go1.25
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// errNoPipes is returned for named pipe addresses on platforms without named pipes, and on Windows when built with a
+// Go release before 1.25, whose os.File lacks the overlapped I/O pipeConn relies on.
+var errNoPipes = errors.New("named pipes are only supported on Windows, built with Go 1.25 or later")
+
+// listenPipe fails since named pipes are not supported, see errNoPipes.
+func listenPipe(name string) (net.Listener, error) {
+	return nil, errNoPipes
+}
+
+// dialPipe fails since named pipes are not supported, see errNoPipes.
+func dialPipe(name string) (net.Conn, error) {
+	return nil, errNoPipes
+}
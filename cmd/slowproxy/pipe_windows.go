@@ -0,0 +1,213 @@
+//go:build windows && go1.25
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Constants of the named pipe API missing from package syscall.
+const (
+	pipeAccessDuplex          = 0x3
+	pipeUnlimitedInstances    = 255
+	fileFlagFirstPipeInstance = 0x80000
+	errorPipeBusy             = syscall.Errno(231)
+	errorPipeConnected        = syscall.Errno(535)
+)
+
+// pipeBufferSize is the size of the input and output buffers of the named pipes listened on.
+const pipeBufferSize = 64 * 1024
+
+var (
+	kernel32             = syscall.NewLazyDLL("kernel32.dll")
+	procCreateNamedPipeW = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe = kernel32.NewProc("ConnectNamedPipe")
+	procCancelIoEx       = kernel32.NewProc("CancelIoEx")
+	procCreateEventW     = kernel32.NewProc("CreateEventW")
+	procGetOverlapped    = kernel32.NewProc("GetOverlappedResult")
+)
+
+// pipeAddr is the name of a named pipe, eg. \\.\pipe\app.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connection over a named pipe. Its handle is opened for overlapped I/O, which os.File supports since
+// Go 1.25, so reading and writing at the same time do not block each other and deadlines work.
+type pipeConn struct {
+	*os.File
+	local, remote pipeAddr // the clients of a pipe are unnamed
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// CloseRead does nothing, named pipes cannot close a single direction.
+func (c *pipeConn) CloseRead() error {
+	return nil
+}
+
+// CloseWrite closes the connection, since named pipes cannot close a single direction: the peer would never see the
+// end of the data otherwise.
+func (c *pipeConn) CloseWrite() error {
+	return c.Close()
+}
+
+// dialPipe connects to the named pipe name. While all instances of the pipe are busy, it retries for as long as
+// dialForward does without local ports.
+func dialPipe(name string) (net.Conn, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	for backoff := minDialBackoff; ; backoff *= 2 {
+		handle, err := syscall.CreateFile(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+			syscall.OPEN_EXISTING, syscall.FILE_FLAG_OVERLAPPED, 0)
+		if err == errorPipeBusy && backoff <= maxDialBackoff {
+			time.Sleep(backoff)
+			continue
+		}
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(name), Err: err}
+		}
+		return &pipeConn{File: os.NewFile(uintptr(handle), name), remote: pipeAddr(name)}, nil
+	}
+}
+
+// pipeListener accepts clients of a named pipe, with a new instance of the pipe for each.
+type pipeListener struct {
+	name string
+
+	mu      sync.Mutex
+	next    syscall.Handle // instance to wait for the next client on, 0 if it has to be created
+	waiting syscall.Handle // instance Accept waits on, 0 if none
+	closed  bool
+}
+
+// listenPipe creates the named pipe name. It fails if another process has created it already.
+func listenPipe(name string) (net.Listener, error) {
+	l := &pipeListener{name: name}
+	handle, err := l.createInstance(true)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(name), Err: err}
+	}
+	l.next = handle
+	return l, nil
+}
+
+// createInstance creates a new instance of the pipe for overlapped I/O. The first instance fails if the pipe exists
+// already.
+func (l *pipeListener) createInstance(first bool) (syscall.Handle, error) {
+	path, err := syscall.UTF16PtrFromString(l.name)
+	if err != nil {
+		return 0, err
+	}
+	mode := uintptr(pipeAccessDuplex | syscall.FILE_FLAG_OVERLAPPED)
+	if first {
+		mode |= fileFlagFirstPipeInstance
+	}
+	// byte stream mode, blocking
+	handle, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(path)), mode, 0, pipeUnlimitedInstances,
+		pipeBufferSize, pipeBufferSize, 0, 0)
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		return 0, err
+	}
+	return syscall.Handle(handle), nil
+}
+
+// Accept waits for the next client to connect to the pipe.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	handle := l.next
+	l.next = 0
+	if handle == 0 {
+		var err error
+		if handle, err = l.createInstance(false); err != nil {
+			l.mu.Unlock()
+			return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.name), Err: err}
+		}
+	}
+	l.waiting = handle
+	l.mu.Unlock()
+
+	err := connectPipe(handle)
+	l.mu.Lock()
+	l.waiting = 0
+	closed := l.closed
+	if err == nil && !closed {
+		// like go-winio, the next instance is created before handing over the client: without an instance, clients
+		// dialing until the next Accept would find no pipe at all rather than a busy one to wait for. If creating it
+		// fails, the next Accept tries again.
+		l.next, _ = l.createInstance(false)
+	}
+	l.mu.Unlock()
+	if err != nil || closed {
+		syscall.CloseHandle(handle)
+		if closed {
+			return nil, net.ErrClosed
+		}
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.name), Err: err}
+	}
+	return &pipeConn{File: os.NewFile(uintptr(handle), l.name), local: pipeAddr(l.name)}, nil
+}
+
+// connectPipe waits for a client to connect to the instance handle, until it does or Close cancels the wait.
+func connectPipe(handle syscall.Handle) error {
+	// manual reset, not signaled
+	h, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if h == 0 {
+		return err
+	}
+	event := syscall.Handle(h)
+	defer syscall.CloseHandle(event)
+	overlapped := syscall.Overlapped{HEvent: event}
+	ok, _, err := procConnectNamedPipe.Call(uintptr(handle), uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 || err == errorPipeConnected {
+		return nil
+	}
+	if err != syscall.ERROR_IO_PENDING {
+		return err
+	}
+	if _, err := syscall.WaitForSingleObject(event, syscall.INFINITE); err != nil {
+		return err
+	}
+	var transferred uint32
+	// fails with ERROR_OPERATION_ABORTED if Close cancelled the wait
+	if ok, _, err := procGetOverlapped.Call(uintptr(handle), uintptr(unsafe.Pointer(&overlapped)),
+		uintptr(unsafe.Pointer(&transferred)), 0); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// Close stops accepting clients, cancelling a pending Accept. Connected clients are not affected.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	if l.waiting != 0 {
+		procCancelIoEx.Call(uintptr(l.waiting), 0)
+	}
+	if l.next != 0 {
+		syscall.CloseHandle(l.next)
+		l.next = 0
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
@@ -0,0 +1,85 @@
+//go:build windows && go1.25
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipeAcceptBurst(t *testing.T) {
+	name := fmt.Sprintf(`\\.\pipe\slowproxy-test-%d`, time.Now().UnixNano())
+	listener, err := listenPipe(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// clients dialing while the listener hands over the previous one find a busy instance to wait for, not none
+	const clients = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dialPipe(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				errs <- err
+				return
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+				errs <- fmt.Errorf("reply %q: %v", reply, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPipeCloseCancelsAccept(t *testing.T) {
+	listener, err := listenPipe(fmt.Sprintf(`\\.\pipe\slowproxy-test-%d`, time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Error("Accept returned a client after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not cancel Accept")
+	}
+}
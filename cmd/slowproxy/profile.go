@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profile is a preset of realistic conditions for a kind of network, in the spirit of the throttling presets of
+// browser developer tools. The latency is one way, so the round-trip time grows by twice as much.
+type profile struct {
+	down, up        int // bytes per second
+	latency, jitter time.Duration
+	name            string // set for the profiles of connections, for logs
+}
+
+// profiles are the presets selectable with -profile.
+var profiles = map[string]profile{
+	"2g-edge":   {down: 240000 / 8, up: 200000 / 8, latency: 400 * time.Millisecond, jitter: 50 * time.Millisecond},
+	"3g":        {down: 1600000 / 8, up: 750000 / 8, latency: 150 * time.Millisecond, jitter: 20 * time.Millisecond},
+	"4g":        {down: 12000000 / 8, up: 5000000 / 8, latency: 35 * time.Millisecond, jitter: 10 * time.Millisecond},
+	"dsl":       {down: 8000000 / 8, up: 1000000 / 8, latency: 10 * time.Millisecond, jitter: 2 * time.Millisecond},
+	"satellite": {down: 15000000 / 8, up: 3000000 / 8, latency: 300 * time.Millisecond, jitter: 30 * time.Millisecond},
+}
+
+// profileNames lists the names of the profiles in alphabetical order.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the throughput, latency and jitter of the profile name in cfg, except for those given explicitly:
+// the flags in set, and THROUGHPUT if cfg.throughput is set already.
+func applyProfile(cfg *config, name string, set map[string]bool) error {
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %s, expected one of %s", name, strings.Join(profileNames(), ", "))
+	}
+	if cfg.throughput == 0 {
+		cfg.throughput = max(p.up, p.down)
+		if !set["up"] {
+			cfg.upThroughput = p.up
+		}
+		if !set["down"] {
+			cfg.downThroughput = p.down
+		}
+	}
+	if !set["latency"] {
+		cfg.latency = p.latency
+	}
+	if !set["jitter"] {
+		cfg.jitter = p.jitter
+	}
+	return nil
+}
+
+// profileMix is a flag.Value for the weighted set of profiles each connection draws its own from, given as
+// PROFILE=WEIGHT separated by commas or in repeated flags, eg. 4g=60,3g=30,2g-edge=10, so a single load test models a
+// population of clients on different networks.
+type profileMix struct {
+	names   []string
+	weights []float64
+	total   float64
+}
+
+func (m *profileMix) String() string {
+	if m == nil {
+		return ""
+	}
+	specs := make([]string, len(m.names))
+	for i, name := range m.names {
+		specs[i] = fmt.Sprintf("%s=%g", name, m.weights[i])
+	}
+	return strings.Join(specs, ",")
+}
+
+func (m *profileMix) Set(s string) error {
+	for _, spec := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("%s is not a profile of the form PROFILE=WEIGHT", spec)
+		}
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf("unknown profile %s, expected one of %s", name, strings.Join(profileNames(), ", "))
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w <= 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return fmt.Errorf("the weight of %s must be a positive number", name)
+		}
+		m.names, m.weights, m.total = append(m.names, name), append(m.weights, w), m.total+w
+	}
+	return nil
+}
+
+// draw returns the name of a profile chosen at random by weight, or an empty string without profiles.
+func (m *profileMix) draw() string {
+	x := rand.Float64() * m.total
+	for i, w := range m.weights {
+		if x < w {
+			return m.names[i]
+		}
+		x -= w
+	}
+	if len(m.names) == 0 {
+		return ""
+	}
+	// rounding left x just beyond the last weight
+	return m.names[len(m.names)-1]
+}
+
+// maxThroughput returns the highest throughput of the profiles in each direction.
+func (m *profileMix) maxThroughput() (up, down int) {
+	for _, name := range m.names {
+		up, down = max(up, profiles[name].up), max(down, profiles[name].down)
+	}
+	return up, down
+}
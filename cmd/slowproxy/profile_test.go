@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestProfileMixWeights(t *testing.T) {
+	for _, spec := range []string{"3g=0", "3g=-1", "3g=NaN", "3g=Inf", "3g=+Inf", "3g=1e400", "3g=heavy", "3g"} {
+		var mix profileMix
+		if err := mix.Set(spec); err == nil {
+			t.Errorf("%s: accepted, want an error", spec)
+		}
+	}
+	var mix profileMix
+	if err := mix.Set("3g=1,4g=0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if mix.total != 1.5 {
+		t.Errorf("total weight %v, want 1.5", mix.total)
+	}
+}
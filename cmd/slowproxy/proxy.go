@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/faults"
+	"github.com/dmiruke/slowproxy/internal/pacer"
+	"github.com/dmiruke/slowproxy/internal/relay"
+)
+
+// proxy holds the state shared by all connections.
+type proxy struct {
+	cfg     *config
+	usage   *ledger // accounts for the transferred bytes, nil without -ledger
+	conns   *registry
+	bufPool *sync.Pool
+
+	// sharedUp and sharedDown schedule the transfers of all connections with -shared
+	sharedUp, sharedDown *pacer.Shared
+
+	acceptErrors *classCounter // by class, see errorClass
+	dialErrors   *classCounter // by class, see errorClass
+	active       int64         // connections being handled, accessed atomically
+	accepted     uint64        // connections accepted since the start, accessed atomically
+	unnamed      uint64        // clients without an address so far, to name them in logs, accessed atomically
+}
+
+// splitAddress splits an address of the command line into the network and the address for package net: Unix domain
+// socket paths are prefixed with unix:, eg. unix:/var/run/app.sock, Windows named pipes are recognized by their path,
+// eg. \\.\pipe\app, for listenPipe and dialPipe, and everything else is a TCP address.
+func splitAddress(address string) (network, addr string) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return "unix", path
+	}
+	if strings.HasPrefix(strings.ToLower(address), `\\.\pipe\`) {
+		return "pipe", address
+	}
+	return "tcp", address
+}
+
+// removeStaleSocket removes the Unix domain socket at path if nothing is listening on it anymore, eg. after a crash,
+// so the address can be listened on again.
+func removeStaleSocket(path string) {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+}
+
+// standbyRetryInterval is how often a standby tries to take over the listen address.
+const standbyRetryInterval = time.Second
+
+// openListener listens on address for the proxy, with the PROXY protocol header and TLS of the clients handled as
+// configured.
+func openListener(cfg *config, address string) (net.Listener, error) {
+	listener, err := listen(cfg, address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.proxyProtocolIn != "" {
+		// the header comes first, before TLS
+		listener = newProxyProtocolListener(listener)
+	}
+	if cfg.tlsCert != "" {
+		secured, err := newTLSListener(listener, cfg.tlsCert, cfg.tlsKey, cfg.tlsClientCA)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		listener = secured
+	}
+	return listener, nil
+}
+
+// listen listens on address. A standby waits as long as the address is in use by the active instance, or
+// not assigned to this host in the case of a shared virtual IP, and takes over as soon as it can.
+//
+// SO_REUSEADDR is set by package net, so restarts are not held up by connections in TIME_WAIT.
+func listen(cfg *config, address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if cfg.reusePort {
+		lc.Control = reusePort
+	}
+	display := address
+	network, address := splitAddress(address)
+	waiting := false
+	for {
+		if network == "unix" {
+			removeStaleSocket(address)
+		}
+		var listener net.Listener
+		var err error
+		if network == "pipe" {
+			listener, err = listenPipe(address)
+		} else {
+			listener, err = lc.Listen(context.Background(), network, address)
+		}
+		if err == nil && waiting {
+			log.Printf("standby: took over %s", display)
+		}
+		if err == nil || !cfg.standby ||
+			!errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return listener, err
+		}
+		if !waiting {
+			log.Printf("standby: waiting for %s: %v", display, err)
+			waiting = true
+		}
+		time.Sleep(standbyRetryInterval)
+	}
+}
+
+func newProxy(cfg *config, usage *ledger) *proxy {
+	px := &proxy{cfg: cfg, usage: usage, conns: newRegistry(), bufPool: newBufPool(cfg.bufSize()),
+		acceptErrors: newClassCounter(), dialErrors: newClassCounter()}
+	if cfg.shared {
+		px.sharedUp, px.sharedDown = &pacer.Shared{}, &pacer.Shared{}
+	}
+	return px
+}
+
+// serve accepts new connections on listener, which listens on the address listen of the command line, and forwards
+// them accordingly to the forward address limiting the throughput (bytes per second) as configured. The integer
+// shuttingDown is used as a flag to indicate that the process is shutting down. If builtin is not empty, the
+// connections are forwarded to that built-in upstream instead, and if fixed is not nil, along that route of a -route
+// listener, see handle.
+func (px *proxy) serve(listener net.Listener, listen string, shuttingDown *uint32, builtin string, fixed *route) {
+	var backoff time.Duration
+	failures := 0
+	for {
+		incomingConn, err := listener.Accept()
+		if atomic.LoadUint32(shuttingDown) != 0 { // if the process is shutting down we can ignore the error if any
+			return
+		}
+		if err != nil {
+			class := errorClass(err)
+			px.acceptErrors.add(class)
+			// only the first error of a series is logged, retrying usually fails the same way many times over
+			if failures == 0 {
+				log.Printf("accept: %v", err)
+			}
+			failures++
+			if class == "EMFILE" || class == "ENFILE" {
+				// out of file descriptors: give open connections a chance to finish instead of spinning
+				backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+				time.Sleep(backoff)
+			}
+			continue
+		}
+		if failures > 1 {
+			log.Printf("accept: recovered after %d errors", failures)
+		}
+		failures, backoff = 0, 0
+		if px.bypassed(incomingConn.RemoteAddr()) {
+			forward := px.cfg.forward
+			if fixed != nil {
+				forward = fixed.forward
+			}
+			go px.bypass(incomingConn.(endpoint), forward, builtin)
+			continue
+		}
+		atomic.AddUint64(&px.accepted, 1)
+
+		if reason := px.overloaded(); reason != "" {
+			log.Printf("%s: rejected, %s", px.cfg.clientName(incomingConn.RemoteAddr()), reason)
+			incomingConn.Close()
+			continue
+		}
+		atomic.AddInt64(&px.active, 1)
+
+		// everything else happens on the connection's own goroutine so that a slow or unreachable upstream does
+		// not hold up accepting the next connection
+		go func() {
+			px.handle(incomingConn.(endpoint), listen, builtin, fixed)
+			atomic.AddInt64(&px.active, -1)
+		}()
+	}
+}
+
+// minAcceptBackoff and maxAcceptBackoff bound the pause after accepting fails for lack of file descriptors. The pause
+// doubles with every consecutive failure.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// errorClass classifies accept and dial errors for counting, by errno where there is one.
+func errorClass(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "other"
+	}
+	switch errno {
+	case syscall.EMFILE:
+		return "EMFILE"
+	case syscall.ENFILE:
+		return "ENFILE"
+	case syscall.ECONNABORTED:
+		return "ECONNABORTED"
+	case syscall.ENOBUFS:
+		return "ENOBUFS"
+	case syscall.ENOMEM:
+		return "ENOMEM"
+	case syscall.EADDRNOTAVAIL:
+		return "EADDRNOTAVAIL"
+	case syscall.ECONNREFUSED:
+		return "ECONNREFUSED"
+	case syscall.ETIMEDOUT:
+		return "ETIMEDOUT"
+	default:
+		return fmt.Sprintf("errno-%d", int(errno))
+	}
+}
+
+// bufSize determines the size of the copy buffers, which bound the data in flight inside the proxy.
+func (cfg *config) bufSize() int {
+	// set the buffer size to the throughput (bytes/second) because it does not make sense to read more than
+	// one second worth of data ahead
+	bufSize := max(cfg.upThroughput, cfg.downThroughput)
+
+	// with a bandwidth-delay product the data in flight is limited further, so clients become window limited
+	if cfg.bdp > 0 {
+		bufSize = min(bufSize, cfg.bdp)
+	}
+	return bufSize
+}
+
+// socketBufSize determines the size of the socket send and receive buffers, 0 to leave them to the kernel's
+// autotuning.
+func (cfg *config) socketBufSize() int {
+	if cfg.socketBuffer < 0 {
+		return cfg.bufSize()
+	}
+	return cfg.socketBuffer
+}
+
+// newBufPool creates a pool of copy buffers of size bufSize. Buffers are recycled between connections so that
+// workloads with many short-lived connections do not pay for two fresh allocations of up to one second worth of data
+// per connection.
+func newBufPool(bufSize int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		buf := make([]byte, bufSize)
+		return &buf
+	}}
+}
+
+// handle dials the forward address for the client connection conn, accepted on the address listen of the command
+// line, and copies data in both directions until both sides are closed. If builtin is not empty, it connects to that
+// built-in upstream instead, under the same conditions.
+func (px *proxy) handle(conn endpoint, listen, builtin string, fixed *route) {
+	cfg, usage, bufPool := px.cfg, px.usage, px.bufPool
+	connName := fmt.Sprint(conn)
+
+	var acct *account
+	header := cfg.upstreamHeader(conn)
+	if netConn, ok := conn.(net.Conn); ok {
+		connName = cfg.clientName(netConn.RemoteAddr())
+		if connName == "" || connName == "@" {
+			// clients of Unix domain sockets are usually unnamed, which Linux shows as @
+			connName = fmt.Sprintf("%s#%d", netConn.LocalAddr(), atomic.AddUint64(&px.unnamed, 1))
+		}
+		if secured, ok := conn.(*tlsConn); ok {
+			// before dialing, so clients that fail to authenticate never reach the upstream
+			if err := secured.handshake(); err != nil {
+				log.Printf("%s: %v", connName, err)
+				conn.Close()
+				return
+			}
+		}
+		if usage != nil {
+			acct = usage.account(netConn.RemoteAddr())
+			if cfg.overQuota(acct) && cfg.quotaAction == "block" {
+				log.Printf("%s: quota of %d bytes exceeded, blocked", connName, cfg.quota)
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	// the hop metadata has to be consumed before the upstream is dialed, so it can be passed on
+	var hops []string
+	if cfg.hopIn {
+		var err error
+		hops, err = readHops(conn)
+		if err != nil {
+			log.Printf("%s: hop metadata: %v", connName, err)
+			conn.Close()
+			return
+		}
+	}
+	hops = append(hops, cfg.hopConditions())
+
+	target := route{forward: cfg.forward}
+	switch {
+	case builtin != "":
+	case fixed != nil:
+		target = *fixed
+	case cfg.socks5:
+		destination, err := readSOCKSRequest(conn)
+		if err != nil {
+			log.Printf("%s: socks5: %v", connName, err)
+			conn.Close()
+			return
+		}
+		target.forward = destination
+		log.Printf("%s: socks5 connect to %s", connName, destination)
+	case len(cfg.tenants) > 0:
+		tenant, r, err := cfg.readTenant(conn)
+		if err != nil {
+			log.Printf("%s: tenant: %v", connName, err)
+			conn.Close()
+			return
+		}
+		target = r
+		if tenant != "" {
+			log.Printf("%s: tenant %s, forwarding to %s", connName, tenant, target)
+		}
+	case len(cfg.sniRoutes) > 0:
+		var host string
+		conn, host, target = cfg.routeBySNI(conn)
+		if host != "" {
+			log.Printf("%s: server name %s, forwarding to %s", connName, host, target)
+		}
+	}
+
+	if target.profile == "" && target.throughput == 0 {
+		target.profile = cfg.profileMix.draw()
+	}
+
+	forwardConn, forwardConnName, err := connectUpstream(cfg, target.forward, header, hops, builtin)
+	if err != nil {
+		px.dialErrors.add(errorClass(err))
+		log.Printf("unable to dial: %v", err)
+		if cfg.socks5 && builtin == "" {
+			writeSOCKSReply(conn, socksReplyCode(err), nil)
+		}
+		if err := conn.Close(); err != nil {
+			log.Printf("%s: unexpected error: %v", connName, err)
+		}
+		return
+	}
+	if cfg.socks5 && builtin == "" {
+		var bound net.Addr
+		if upstreamConn, ok := forwardConn.(net.Conn); ok {
+			bound = upstreamConn.LocalAddr()
+		}
+		if err := writeSOCKSReply(conn, socksSucceeded, bound); err != nil {
+			log.Printf("%s: socks5: %v", connName, err)
+			conn.Close()
+			forwardConn.Close()
+			return
+		}
+	}
+	if cfg.hopIn && !cfg.hopOut {
+		// this is the final hop, so it reports the conditions applied along the whole path
+		log.Printf("%s: path: %s", connName, formatHops(hops))
+	}
+
+	if connTcp, ok := tcpConnOf(conn); ok {
+		setTcpConnBuffers(connTcp, cfg.socketBufSize())
+		if cfg.windowClamp > 0 && cfg.windowClampLeg != "upstream" {
+			if err := clampWindow(connTcp, cfg.windowClamp); err != nil {
+				log.Printf("%s: window clamp: %v", connName, err)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	if cfg.migrateEvery > 0 || cfg.reconnect > 0 {
+		dial := func() (endpoint, error) {
+			upstream, _, err := connectUpstream(cfg, target.forward, header, hops, builtin)
+			if err != nil {
+				px.dialErrors.add(errorClass(err))
+			}
+			return upstream, err
+		}
+		migrating := newMigratingConn(forwardConn, cfg.migratePolicy == "drop")
+		if cfg.reconnect > 0 {
+			migrating.redial, migrating.redialFor = dial, cfg.reconnect
+			migrating.replay, migrating.name = cfg.reconnectReplay, connName
+		}
+		if cfg.migrateEvery > 0 {
+			go migrating.migrateEvery(cfg.migrateEvery, cfg.migrateGap, dial, connName, done)
+		}
+		forwardConn = migrating
+	}
+
+	// one direction runs on the current goroutine, which saves spawning a second one per connection
+	c := &connection{name: connName, listener: listen, client: conn, upstream: forwardConn, account: acct,
+		opened: time.Now(), sampled: rand.Float64() < cfg.sampleRate}
+	c.touch()
+	up, down := cfg.live.currentThroughput()
+	upstream := newPipe(c, cfg, relay.Up, forwardConn, conn, forwardConnName, connName, up, px.sharedUp)
+	downstream := newPipe(c, cfg, relay.Down, conn, forwardConn, connName, forwardConnName, down, px.sharedDown)
+	downstream.CloseDelay, downstream.ReadSize, downstream.ReadGap = cfg.closeDelay, cfg.upstreamReadSize,
+		cfg.upstreamReadGap
+	if up, down, ok := target.pinnedThroughput(); ok {
+		// the route's own conditions apply to each of its connections, regardless of -shared and runtime changes
+		upstream.throughput, downstream.throughput = up, down
+		for _, p := range []*pipe{upstream, downstream} {
+			p.pinned, p.Shared = true, nil
+		}
+	}
+	if p, ok := profiles[target.profile]; ok {
+		p.name = target.profile
+		c.profile = &p
+	}
+	if cfg.messageRate > 0 {
+		// the framing is validated when parsing the command line
+		upstream.Messages, _ = pacer.NewMessagePacer(cfg.framing, cfg.messageRate)
+		downstream.Messages, _ = pacer.NewMessagePacer(cfg.framing, cfg.messageRate)
+	}
+	if cfg.garbleLines > 0 || cfg.truncateLines > 0 {
+		if cfg.corruptDirection != "downstream" {
+			upstream.Corrupter = faults.NewLineCorrupter(cfg.garbleLines, cfg.truncateLines)
+		}
+		if cfg.corruptDirection != "upstream" {
+			downstream.Corrupter = faults.NewLineCorrupter(cfg.garbleLines, cfg.truncateLines)
+		}
+	}
+	upstream.Blackhole, downstream.Blackhole = cfg.blackholeFor("upstream"), cfg.blackholeFor("downstream")
+	c.up, c.down = upstream, downstream
+	c.noteConditions(cfg)
+	px.conns.add(c)
+	defer px.conns.remove(c)
+	c.logf(logEntry{Event: "open"}, "%s open", connName)
+
+	if cfg.idleReset > 0 {
+		go c.resetWhenIdle(cfg.idleReset, done)
+	}
+	if cfg.killRate > 0 {
+		go c.killRandomly(cfg.killRate, cfg.killWith == "rst", done)
+	}
+
+	// a direction stalled by the blackhole stops once the other one is done
+	upstreamDone, downstreamDone := make(chan struct{}), make(chan struct{})
+	upstream.Stop, downstream.Stop = downstreamDone, upstreamDone
+	go func() {
+		upstream.run(bufPool)
+		close(upstreamDone)
+	}()
+	downstream.run(bufPool)
+	close(downstreamDone)
+	<-upstreamDone
+	close(done)
+
+	// both directions are done, so the connections can be released
+	conn.Close()
+	forwardConn.Close()
+	duration := time.Since(c.opened)
+	bytesUp, bytesDown := upstream.sample().transferred, downstream.sample().transferred
+	throughputUp, throughputDown := float64(bytesUp)/duration.Seconds(), float64(bytesDown)/duration.Seconds()
+	c.logf(logEntry{Event: "ended", Reason: c.endReason(), BytesUp: &bytesUp, BytesDown: &bytesDown,
+		ThroughputUp: &throughputUp, ThroughputDown: &throughputDown, Duration: duration.Seconds()},
+		"%s: ended by %s after %v, up %d bytes at %.0f bytes/s, down %d bytes at %.0f bytes/s, conditions: %s",
+		connName, c.endReason(), duration.Round(time.Millisecond), bytesUp, throughputUp, bytesDown, throughputDown,
+		c.conditionHistory())
+}
+
+// endpoint is one side of a proxied connection, see relay.Endpoint.
+type endpoint = relay.Endpoint
+
+// connectUpstream dials the upstream and prepares the connection for forwarding: it sends the hop metadata if
+// configured and adjusts the socket buffer sizes and window clamp of TCP connections. It also returns the name
+// identifying the upstream in logs. A builtin that is not empty overrides the configured upstream and the PROXY
+// protocol header, see dialForward.
+func connectUpstream(cfg *config, forward string, header []byte, hops []string,
+	builtin string) (endpoint, string, error) {
+	conn, name, err := dialForward(cfg, forward, header, builtin)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cfg.hopOut && builtin == "" {
+		if err := writeHops(conn, hops); err != nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("%s: hop metadata: %w", name, err)
+		}
+	}
+	if connTcp, ok := tcpConnOf(conn); ok {
+		setTcpConnBuffers(connTcp, cfg.socketBufSize())
+		// package net disables Nagle's algorithm, so every read goes out in its own segments by default
+		connTcp.SetNoDelay(!cfg.coalesce)
+		if cfg.windowClamp > 0 && cfg.windowClampLeg != "client" {
+			if err := clampWindow(connTcp, cfg.windowClamp); err != nil {
+				log.Printf("%s: window clamp: %v", name, err)
+			}
+		}
+	}
+	return conn, name, nil
+}
+
+// minDialBackoff and maxDialBackoff bound the pause before dialing the forward address again when there are no local
+// ports left. The pause doubles with every attempt, from 10ms to 640ms, which retries for about 1.3 seconds in total.
+const (
+	minDialBackoff = 10 * time.Millisecond
+	maxDialBackoff = time.Second
+)
+
+// dialForward connects to the upstream, which is either the address forward, usually FORWARD, a new process with
+// -forward-exec or a built-in upstream with -forward-builtin. Connections to the forward address are wrapped in TLS
+// with -upstream-tls. A builtin that is not empty overrides all of these, eg. for -echo-listen. The PROXY protocol
+// header, if any, is sent first on connections to the forward address, before TLS. It also returns the name
+// identifying the upstream in logs.
+func dialForward(cfg *config, forward string, header []byte, builtin string) (endpoint, string, error) {
+	if builtin == "" {
+		builtin = cfg.forwardBuiltin
+	}
+	if builtin != "" {
+		builtin, err := newBuiltin(builtin, cfg.chargenRate)
+		if err != nil {
+			return nil, "", err
+		}
+		return builtin, fmt.Sprint(builtin), nil
+	}
+	if cfg.forwardExec != "" {
+		proc, err := startExec(cfg.forwardExec)
+		if err != nil {
+			return nil, "", err
+		}
+		return proc, proc.String(), nil
+	}
+
+	// with many connections opened and closed in quick succession the local ports may run out until the ones in
+	// TIME_WAIT are released, so the dial is retried for a while
+	network, address := splitAddress(forward)
+	backoff := minDialBackoff
+	for {
+		var conn net.Conn
+		var err error
+		if network == "pipe" {
+			conn, err = dialPipe(address)
+		} else {
+			conn, err = net.Dial(network, address)
+		}
+		if errors.Is(err, syscall.EADDRNOTAVAIL) && backoff <= maxDialBackoff {
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if header != nil {
+			if _, err := conn.Write(header); err != nil {
+				conn.Close()
+				return nil, "", fmt.Errorf("%s: PROXY protocol header: %w", conn.RemoteAddr(), err)
+			}
+		}
+		if cfg.upstreamTLS != nil {
+			return startUpstreamTLS(conn, cfg.upstreamTLS)
+		}
+		return conn.(endpoint), conn.RemoteAddr().String(), nil
+	}
+}
+
+// minSocketBuffer is the smallest socket buffer size setTcpConnBuffers falls back to.
+const minSocketBuffer = 4096
+
+// setTcpConnBuffers adjusts the connection read and write buffer sizes to the specified value. A bufSize of 0 leaves
+// them to the kernel's autotuning. Linux caps sizes beyond its maximum, while macOS and the BSDs reject them with
+// ENOBUFS, so rejected sizes are halved until they are accepted and the buffers end up close to the maximum either
+// way.
+func setTcpConnBuffers(conn *net.TCPConn, bufSize int) {
+	if bufSize == 0 {
+		return
+	}
+	setSocketBuffer(conn.SetReadBuffer, bufSize)
+	setSocketBuffer(conn.SetWriteBuffer, bufSize)
+}
+
+// setSocketBuffer sets a socket buffer to size with set, halving the sizes set rejects down to minSocketBuffer. It
+// returns the size set accepted, or 0 if it rejected all of them.
+func setSocketBuffer(set func(int) error, size int) int {
+	for ; size >= minSocketBuffer; size /= 2 {
+		if set(size) == nil {
+			return size
+		}
+	}
+	return 0
+}
+
+// clientName identifies a client connection from addr in logs. If anonymizeSalt is set the IP address is replaced by
+// a salted hash, which still allows correlating the connections of one client without recording its address.
+func (cfg *config) clientName(addr net.Addr) string {
+	if cfg.anonymizeSalt == "" {
+		return addr.String()
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host, port = addr.String(), ""
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.anonymizeSalt))
+	mac.Write([]byte(host))
+	name := "client-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	if port != "" {
+		name = net.JoinHostPort(name, port)
+	}
+	return name
+}
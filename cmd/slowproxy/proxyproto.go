@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// maxProxyV1Line is the longest PROXY protocol version 1 header allowed by the specification, without the newline.
+const maxProxyV1Line = 106
+
+// proxyHeaderTimeout is how long to wait for the PROXY protocol header with -proxy-protocol-in.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyHeader returns the PROXY protocol header of version, v1 or v2, announcing a connection from source to
+// destination, so the upstream sees the client's address rather than the proxy's, eg. with HAProxy, nginx or
+// PostgreSQL. It returns nil without a version. Connections that are not between TCP addresses, eg. from clients of
+// Unix domain sockets, are announced as unknown, for which upstreams use the address of the connection as usual.
+func proxyHeader(version string, source, destination net.Addr) []byte {
+	if version == "" {
+		return nil
+	}
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	known := srcOk && dstOk
+	// both addresses have to be of the same family, so an IPv4 address facing an IPv6 one is announced mapped
+	ipv4 := known && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	if version == "v1" {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src.IP.To16(), dst.IP.To16(), src.Port,
+				dst.Port))
+		}
+	}
+
+	header := []byte(proxyV2Signature)
+	if !known {
+		// the LOCAL command without addresses
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+	var addresses []byte
+	family := byte(0x11) // TCP over IPv4
+	if ipv4 {
+		addresses = append(append(addresses, src.IP.To4()...), dst.IP.To4()...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(src.Port))
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(dst.Port))
+	// the PROXY command
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// upstreamHeader returns the PROXY protocol header to send to the upstream for the client connection conn, if any:
+// the header as received with -proxy-protocol-in pass, or one announcing the client's address with
+// -proxy-protocol-out.
+func (cfg *config) upstreamHeader(conn endpoint) []byte {
+	if cfg.proxyProtocolIn == "pass" {
+		if proxied, ok := proxiedConnOf(conn); ok {
+			return proxied.header
+		}
+		return nil
+	}
+	if netConn, ok := conn.(net.Conn); ok {
+		return proxyHeader(cfg.proxyProtocolOut, netConn.RemoteAddr(), netConn.LocalAddr())
+	}
+	// the client's address is unknown, eg. when tunnelling stdin/stdout
+	return proxyHeader(cfg.proxyProtocolOut, nil, nil)
+}
+
+// proxyProtocolListener reads the PROXY protocol header a load balancer sends first on each connection with
+// -proxy-protocol-in, so the connections it accepts have the address of the actual client rather than the load
+// balancer's. Connections without a valid header are logged and closed. The headers are read on the connections' own
+// goroutines, so a slow client does not hold up accepting others.
+type proxyProtocolListener struct {
+	net.Listener
+	accepted chan acceptResult
+	done     chan struct{} // closed once the underlying listener is closed
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newProxyProtocolListener(listener net.Listener) net.Listener {
+	l := &proxyProtocolListener{Listener: listener, accepted: make(chan acceptResult), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// errors are passed on, so serve handles them as usual
+			if !l.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				log.Printf("%s: PROXY protocol header: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if !l.deliver(acceptResult{conn: proxied}) {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// deliver hands result to Accept, unless the listener has been closed meanwhile.
+func (l *proxyProtocolListener) deliver(result acceptResult) bool {
+	select {
+	case l.accepted <- result:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// Accept returns the next connection whose header has been read.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.accepted:
+		return result.conn, result.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// proxiedConn is a connection from a load balancer with the addresses announced in its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	source, destination net.Addr
+	header              []byte // as received, for -proxy-protocol-in pass
+}
+
+// RemoteAddr returns the address of the client of the load balancer.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+// LocalAddr returns the address the client connected to at the load balancer.
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.destination
+}
+
+func (c *proxiedConn) CloseRead() error {
+	if conn, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return conn.CloseRead()
+	}
+	return nil
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// proxiedConnOf returns the connection with a PROXY protocol header underlying e, if there is one.
+func proxiedConnOf(e endpoint) (*proxiedConn, bool) {
+	if c, ok := e.(*peekedConn); ok {
+		e = c.endpoint
+	}
+	if c, ok := e.(*tlsConn); ok {
+		conn, ok := c.NetConn().(*proxiedConn)
+		return conn, ok
+	}
+	conn, ok := e.(*proxiedConn)
+	return conn, ok
+}
+
+// readProxyHeader reads the PROXY protocol header of either version from conn within proxyHeaderTimeout. Headers of
+// the LOCAL command, eg. from health checks, and of unknown or Unix domain socket addresses leave the addresses of
+// conn.
+func readProxyHeader(conn net.Conn) (*proxiedConn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	proxied := &proxiedConn{Conn: conn, source: conn.RemoteAddr(), destination: conn.LocalAddr()}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, err
+	}
+	var err error
+	switch first[0] {
+	case 'P':
+		err = proxied.readV1(conn)
+	case proxyV2Signature[0]:
+		err = proxied.readV2(conn)
+	default:
+		err = errors.New("missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proxied, conn.SetReadDeadline(time.Time{})
+}
+
+// readV1 reads the rest of a version 1 header, after its first byte.
+func (c *proxiedConn) readV1(conn net.Conn) error {
+	line, err := readLine(conn, proxyHeaderTimeout, maxProxyV1Line-1)
+	if err != nil {
+		return err
+	}
+	line = "P" + line
+	c.header = []byte(line + "\n")
+	fields := strings.Split(strings.TrimSuffix(line, "\r"), " ")
+	if !strings.HasSuffix(line, "\r") || len(fields) < 2 || fields[0] != "PROXY" {
+		return fmt.Errorf("unexpected line %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return fmt.Errorf("unexpected line %q", line)
+	}
+	var addrs [2]*net.TCPAddr
+	for i := range addrs {
+		ip := net.ParseIP(fields[2+i])
+		port, err := strconv.ParseUint(fields[4+i], 10, 16)
+		if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || err != nil {
+			return fmt.Errorf("unexpected line %q", line)
+		}
+		addrs[i] = &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	c.source, c.destination = addrs[0], addrs[1]
+	return nil
+}
+
+// readV2 reads the rest of a version 2 header, after its first byte.
+func (c *proxiedConn) readV2(conn net.Conn) error {
+	header := make([]byte, 16)
+	header[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return err
+	}
+	if string(header[:12]) != proxyV2Signature || header[12]>>4 != 2 {
+		return errors.New("missing")
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(conn, addresses); err != nil {
+		return err
+	}
+	c.header = append(header, addresses...)
+
+	command, family := header[12]&0xf, header[13]>>4
+	switch {
+	case command == 0:
+		// LOCAL
+		return nil
+	case command != 1:
+		return fmt.Errorf("unknown command %d", command)
+	}
+	size := 0
+	switch family {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		// unspecified or Unix domain sockets
+		return nil
+	}
+	if len(addresses) < 2*size+4 {
+		return errors.New("addresses too short")
+	}
+	ports := addresses[2*size:]
+	c.source = &net.TCPAddr{IP: net.IP(addresses[:size]), Port: int(binary.BigEndian.Uint16(ports))}
+	c.destination = &net.TCPAddr{IP: net.IP(addresses[size : 2*size]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reloadedSettings are the settings of a configuration file that a reload applies to the running proxy. They are the
+// conditions that can be changed at runtime like through -admin and -interactive.
+var reloadedSettings = map[string]bool{"throughput": true, "up": true, "down": true, "latency": true, "jitter": true}
+
+// reloadOnHangup reads the configuration file at path again whenever the process receives SIGHUP and applies the
+// reloadedSettings that changed, except those in commandLine, as the command line takes precedence. The
+// changes reach open connections unless -apply-changes new is given. Other settings take a restart, so a change of
+// them is only logged, and settings removed from the file keep their current value.
+func (px *proxy) reloadOnHangup(path string, commandLine map[string]bool, audit *auditLog) {
+	previous, err := readConfigValues(path)
+	if err != nil {
+		log.Printf("reload: %v", err)
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		settings, err := readConfigValues(path)
+		if err != nil {
+			// the previous settings stay in effect until the file is fixed
+			log.Printf("reload: %v", err)
+			continue
+		}
+		if err := px.reload(path, settings, previous, commandLine, audit); err != nil {
+			log.Printf("reload: %v", err)
+			continue
+		}
+		previous = settings
+	}
+}
+
+// readConfigValues reads the values of the settings in the configuration file at path by name, with the lines they
+// are on.
+func readConfigValues(path string) (map[string]configSetting, error) {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]configSetting{}
+	for _, s := range settings {
+		values[s.name] = s
+	}
+	return values, nil
+}
+
+// reload applies the reloadedSettings in settings, read from the file at path, that changed since previous. Nothing is
+// applied if any of them is invalid.
+func (px *proxy) reload(path string, settings, previous map[string]configSetting, commandLine map[string]bool,
+	audit *auditLog) error {
+	live := &px.cfg.live
+	previousUp, previousDown := live.currentThroughput()
+	previousLatency, previousJitter := live.currentLatency()
+	up, down := previousUp, previousDown
+	latency, jitter := previousLatency, previousJitter
+
+	var restart []string
+	for name, s := range settings {
+		if strings.Join(s.values, ",") == strings.Join(previous[name].values, ",") || commandLine[name] {
+			continue
+		}
+		if !reloadedSettings[name] {
+			restart = append(restart, name)
+			continue
+		}
+		fail := func(err error) error {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, s.line, s.values[0], name, err)
+		}
+		switch name {
+		case "throughput", "up", "down":
+			throughput, err := parseThroughput(s.values[0])
+			if err == nil && throughput <= 0 {
+				err = fmt.Errorf("must be at least 1 byte per second")
+			}
+			if err != nil {
+				return fail(err)
+			}
+			// -up and -down take precedence over THROUGHPUT, as at the start
+			given := func(direction string) bool { return settings[direction].values != nil || commandLine[direction] }
+			if name == "up" || name == "throughput" && !given("up") {
+				up = throughput
+			}
+			if name == "down" || name == "throughput" && !given("down") {
+				down = throughput
+			}
+		case "latency", "jitter":
+			d, err := time.ParseDuration(s.values[0])
+			if err == nil && d < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+			if err != nil {
+				return fail(err)
+			}
+			if name == "latency" {
+				latency = d
+			} else {
+				jitter = d
+			}
+		}
+	}
+
+	who := operator()
+	if up != previousUp || down != previousDown {
+		live.setThroughput(up, down)
+		audit.record(who, "reload", "throughput down %d -> %d, up %d -> %d", previousDown, down, previousUp, up)
+		log.Printf("reload: throughput down %d -> %d, up %d -> %d", previousDown, down, previousUp, up)
+	}
+	if latency != previousLatency || jitter != previousJitter {
+		live.setLatency(latency, jitter)
+		audit.record(who, "reload", "latency %v -> %v, jitter %v -> %v", previousLatency, latency, previousJitter,
+			jitter)
+		log.Printf("reload: latency %v -> %v, jitter %v -> %v", previousLatency, latency, previousJitter, jitter)
+	}
+	if len(restart) > 0 {
+		log.Printf("reload: %s changed, which takes a restart", strings.Join(restart, ", "))
+	}
+	px.conns.noteConditions(px.cfg)
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	cfg := &config{listen: ":8080", forward: "localhost:80"}
+	cfg.live.setThroughput(1000, 1000)
+	cfg.live.setLatency(10*time.Millisecond, 0)
+	px := newProxy(cfg, nil)
+	previous, err := readConfigValues(writeConfig(t, "throughput: 1k\nup: 1k\nlatency: 10ms\njitter: 0s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandLine := map[string]bool{"jitter": true}
+
+	// -up stays as it is while THROUGHPUT changes, and -jitter was given on the command line
+	path := writeConfig(t, "throughput: 2k\nup: 1k\nlatency: 20ms\njitter: 5ms\nmax-conns: 5\n")
+	settings, err := readConfigValues(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := px.reload(path, settings, previous, commandLine, nil); err != nil {
+		t.Fatal(err)
+	}
+	if up, down := cfg.live.currentThroughput(); up != 1000 || down != 2000 {
+		t.Errorf("throughput up %d, down %d, want up 1000, down 2000", up, down)
+	}
+	if latency, jitter := cfg.live.currentLatency(); latency != 20*time.Millisecond || jitter != 0 {
+		t.Errorf("latency %v, jitter %v, want 20ms and 0s", latency, jitter)
+	}
+
+	// nothing is applied from a file with an invalid value
+	path = writeConfig(t, "throughput: 4k\nlatency: soon\n")
+	invalid, err := readConfigValues(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = px.reload(path, invalid, settings, commandLine, nil)
+	checkError(t, "latency: soon", err, `config.yaml:2: invalid value "soon" for latency`)
+	if _, down := cfg.live.currentThroughput(); down != 2000 {
+		t.Errorf("throughput down %d after an invalid file, want 2000", down)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// soReusePort is the value of SO_REUSEPORT, which package syscall lacks on most Linux architectures.
+func soReusePort() int {
+	if runtime.GOOS == "linux" && !strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0xf
+	}
+	return 0x200 // the BSDs and Linux on MIPS
+}
+
+// reusePort sets SO_REUSEPORT on a listening socket before it is bound, so several processes can share the address.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// route is where a connection is forwarded to and the conditions applied to it when the proxy serves several
+// upstreams, see -sni-route and -tenant.
+type route struct {
+	forward    string
+	throughput int    // bytes per second in each direction for each connection, 0 for THROUGHPUT
+	profile    string // name of the profile applied to each connection instead of THROUGHPUT, see profiles
+}
+
+// String describes the route in the notation of parseRoute.
+func (r route) String() string {
+	switch {
+	case r.profile != "":
+		return r.forward + "@" + r.profile
+	case r.throughput > 0:
+		return fmt.Sprintf("%s@%d", r.forward, r.throughput)
+	default:
+		return r.forward
+	}
+}
+
+// parseRoute parses FORWARD[@THROUGHPUT] or FORWARD@PROFILE.
+func parseRoute(s string) (route, error) {
+	forward, conditions, ok := strings.Cut(s, "@")
+	if forward == "" || ok && conditions == "" {
+		return route{}, fmt.Errorf("%s is not a route of the form FORWARD[@THROUGHPUT|@PROFILE]", s)
+	}
+	r := route{forward: forward}
+	if !ok {
+		return r, nil
+	}
+	if _, ok := profiles[conditions]; ok {
+		r.profile = conditions
+		return r, nil
+	}
+	throughput, err := parseThroughput(conditions)
+	if err != nil {
+		return route{}, fmt.Errorf("%s is neither a profile nor a throughput", conditions)
+	}
+	if throughput <= 0 {
+		return route{}, fmt.Errorf("the throughput of the route to %s must be at least 1 byte per second", forward)
+	}
+	r.throughput = throughput
+	return r, nil
+}
+
+// pinnedThroughput returns the throughput towards the upstream and towards the client the route applies to each of its
+// connections, if it has its own.
+func (r route) pinnedThroughput() (up, down int, ok bool) {
+	if p, ok := profiles[r.profile]; ok {
+		return p.up, p.down, true
+	}
+	return r.throughput, r.throughput, r.throughput > 0
+}
+
+// routes is a flag.Value for routes by name, given as NAME=FORWARD[@THROUGHPUT|@PROFILE] separated by commas or in
+// repeated flags, eg. api.example.com=10.0.0.1:443@1M,static.example.com=10.0.0.2:443@3g. Names are case-insensitive.
+type routes map[string]route
+
+func (r *routes) String() string {
+	if r == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*r))
+	for name := range *r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	specs := make([]string, len(names))
+	for i, name := range names {
+		specs[i] = name + "=" + (*r)[name].String()
+	}
+	return strings.Join(specs, ",")
+}
+
+// listenRoutes is a flag.Value for additional addresses to listen on, each with the route of its connections, given as
+// LISTEN=FORWARD[@THROUGHPUT|@PROFILE] separated by commas or in repeated flags, eg.
+// localhost:5433=db:5432@1M,localhost:6380=cache:6379@3g.
+type listenRoutes map[string]route
+
+func (r *listenRoutes) String() string {
+	if r == nil {
+		return ""
+	}
+	listens := make([]string, 0, len(*r))
+	for listen := range *r {
+		listens = append(listens, listen)
+	}
+	sort.Strings(listens)
+	specs := make([]string, len(listens))
+	for i, listen := range listens {
+		specs[i] = listen + "=" + (*r)[listen].String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (r *listenRoutes) Set(s string) error {
+	if *r == nil {
+		*r = listenRoutes{}
+	}
+	for _, spec := range strings.Split(s, ",") {
+		listen, forward, ok := strings.Cut(spec, "=")
+		if !ok || listen == "" {
+			return fmt.Errorf("%s is not a route of the form LISTEN=FORWARD[@THROUGHPUT|@PROFILE]", spec)
+		}
+		route, err := parseRoute(forward)
+		if err != nil {
+			return err
+		}
+		(*r)[listen] = route
+	}
+	return nil
+}
+
+func (r *routes) Set(s string) error {
+	if *r == nil {
+		*r = routes{}
+	}
+	for _, spec := range strings.Split(s, ",") {
+		name, forward, ok := strings.Cut(spec, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("%s is not a route of the form NAME=FORWARD[@THROUGHPUT|@PROFILE]", spec)
+		}
+		route, err := parseRoute(forward)
+		if err != nil {
+			return err
+		}
+		(*r)[strings.ToLower(name)] = route
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// scheduleStep is a throughput taking effect at an offset from the start of the proxy.
+type scheduleStep struct {
+	at         time.Duration
+	throughput int
+}
+
+// parseSchedule parses a throughput schedule such as 0s=1M,30s=128k,60s=1M: a comma separated list of offsets from
+// the start of the proxy and the throughput from then on, in the notations understood by parseThroughput. The offsets
+// must be increasing.
+func parseSchedule(s string) ([]scheduleStep, error) {
+	var steps []scheduleStep
+	for _, entry := range strings.Split(s, ",") {
+		at, throughput, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %s is not OFFSET=THROUGHPUT", entry)
+		}
+		offset, err := time.ParseDuration(at)
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %s: %w", entry, err)
+		}
+		if len(steps) > 0 && offset <= steps[len(steps)-1].at {
+			return nil, fmt.Errorf("schedule entry %s does not come after the previous one", entry)
+		}
+		step := scheduleStep{at: offset}
+		if step.throughput, err = parseThroughput(throughput); err != nil {
+			return nil, fmt.Errorf("schedule entry %s: %w", entry, err)
+		}
+		if step.throughput <= 0 {
+			return nil, fmt.Errorf("schedule entry %s: the throughput must be at least 1 byte per second", entry)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// runSchedule sets the throughput in both directions according to -schedule, counting from started. It returns after
+// the last step, whose throughput stays in effect. The change is noted for the open connections in conns.
+func runSchedule(cfg *config, conns *registry, started time.Time) {
+	for _, step := range cfg.schedule {
+		time.Sleep(time.Until(started.Add(step.at)))
+		cfg.live.setThroughput(step.throughput, step.throughput)
+		conns.noteConditions(cfg)
+		log.Printf("schedule: throughput set to %d bytes/s", step.throughput)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// clientHelloTimeout is how long to wait for the client's TLS ClientHello when routing by server name.
+const clientHelloTimeout = 5 * time.Second
+
+// maxTLSRecord is the largest TLS record a ClientHello is read from, the maximum plaintext record size plus the header.
+const maxTLSRecord = 5 + 16384
+
+// routeBySNI picks the route for the server name the client asked for. Connections terminated with -tls-cert have
+// completed the handshake already, so the name is taken from it; otherwise the first TLS record is read, which should
+// hold the ClientHello, and the connection returned in place of conn replays it to the upstream. Connections without a
+// server name or for a name without a route use FORWARD and THROUGHPUT.
+func (cfg *config) routeBySNI(conn endpoint) (endpoint, string, route) {
+	var host string
+	if secured, ok := conn.(*tlsConn); ok {
+		host = secured.ConnectionState().ServerName
+	} else if record := readTLSRecord(conn); len(record) > 0 {
+		conn = &peekedConn{endpoint: conn, peeked: record}
+		host = clientHelloServerName(record)
+	}
+
+	r, ok := cfg.sniRoutes[strings.ToLower(host)]
+	if !ok {
+		r = route{forward: cfg.forward}
+	}
+	return conn, host, r
+}
+
+// readTLSRecord reads a single TLS record, within clientHelloTimeout if conn supports deadlines. It returns what it
+// read even if that is not a complete record: clients speaking other protocols are forwarded unchanged, and errors
+// reading recur once the connection is forwarded.
+func readTLSRecord(conn endpoint) []byte {
+	deadliner, hasDeadline := conn.(interface{ SetReadDeadline(time.Time) error })
+	if hasDeadline {
+		deadliner.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+		defer deadliner.SetReadDeadline(time.Time{})
+	}
+
+	record := make([]byte, 5, maxTLSRecord)
+	if n, err := io.ReadFull(conn, record); err != nil {
+		return record[:n]
+	}
+	length := int(record[3])<<8 | int(record[4])
+	if record[0] != 0x16 || 5+length > maxTLSRecord {
+		// not a handshake record
+		return record
+	}
+	record = record[:5+length]
+	n, _ := io.ReadFull(conn, record[5:])
+	return record[:5+n]
+}
+
+// clientHelloServerName returns the host name in the server name extension of the ClientHello in record, or "" if
+// record does not hold a ClientHello with a valid one.
+func clientHelloServerName(record []byte) string {
+	r := tlsReader(record)
+	if recordType, _ := r.bytes(1); len(recordType) != 1 || recordType[0] != 0x16 {
+		return ""
+	}
+	r.bytes(2) // version
+	r = r.vector(2)
+	if handshakeType, _ := r.bytes(1); len(handshakeType) != 1 || handshakeType[0] != 0x01 {
+		return ""
+	}
+	r = r.vector(3)
+	r.bytes(2 + 32) // client version and random
+	r.vector(1)     // session id
+	r.vector(2)     // cipher suites
+	r.vector(1)     // compression methods
+
+	extensions := r.vector(2)
+	for len(extensions) > 0 {
+		extensionType, ok := extensions.bytes(2)
+		if !ok {
+			return ""
+		}
+		extension := extensions.vector(2)
+		if extensionType[0] != 0 || extensionType[1] != 0 {
+			continue
+		}
+		names := extension.vector(2)
+		for len(names) > 0 {
+			nameType, _ := names.bytes(1)
+			name := names.vector(2)
+			if len(nameType) == 1 && nameType[0] == 0 && validHostName(string(name)) {
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// tlsReader consumes the fields of a TLS message. Reading past the end empties it rather than failing, so parsing
+// malformed messages ends without a result.
+type tlsReader []byte
+
+// bytes consumes the next n bytes and returns whether there were as many.
+func (r *tlsReader) bytes(n int) (tlsReader, bool) {
+	if len(*r) < n {
+		*r = nil
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+// vector consumes a variable-length field with a big-endian length prefix of lengthSize bytes and returns its
+// contents.
+func (r *tlsReader) vector(lengthSize int) tlsReader {
+	prefix, ok := r.bytes(lengthSize)
+	if !ok {
+		return nil
+	}
+	length := 0
+	for _, b := range prefix {
+		length = length<<8 | int(b)
+	}
+	v, _ := r.bytes(length)
+	return v
+}
+
+// peekedConn is a connection whose first bytes have been read already to look at them, and returns them again before
+// reading on.
+type peekedConn struct {
+	endpoint
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.endpoint.Read(p)
+}
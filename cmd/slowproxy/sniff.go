@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// The parsers of what clients send, the HTTP request line here, the TLS ClientHello in sni.go, the SOCKS5 negotiation
+// in socks.go and the hop and tenant lines, all read a bounded number of bytes within a bounded time, and only pass on
+// names that are safe to log. A malformed client must never crash or hang the proxy.
+
+// listenerSet is a flag.Value for a set of listen addresses, given separated by commas or in repeated flags, see
+// -no-sniff. Shaping works on the bytes alone, so nested tunnels are shaped like any other stream either way, but
+// without sniffing nothing can mistake their first bytes for a request line or a ClientHello.
+type listenerSet map[string]bool
+
+func (s *listenerSet) String() string {
+	if s == nil {
+		return ""
+	}
+	listens := make([]string, 0, len(*s))
+	for listen := range *s {
+		listens = append(listens, listen)
+	}
+	sort.Strings(listens)
+	return strings.Join(listens, ",")
+}
+
+func (s *listenerSet) Set(value string) error {
+	if *s == nil {
+		*s = listenerSet{}
+	}
+	for _, listen := range strings.Split(value, ",") {
+		(*s)[listen] = true
+	}
+	return nil
+}
+
+// maxLabelLength bounds the length of connection labels, long URLs would make logs unreadable.
+const maxLabelLength = 80
+
+// maxRequestLine bounds how much of the first chunk is searched for an HTTP request line.
+const maxRequestLine = 8192
+
+// maxHostName is the maximum length of a DNS host name.
+const maxHostName = 253
+
+// httpRequestLabel extracts the method and target of an HTTP request line at the start of data, eg. "GET /index.html",
+// for labelling the connection. It returns "" if data does not start with a request line, eg. for TLS or a tunnel
+// protocol. Either way the data is forwarded and shaped unchanged, labels are only used in logs and statistics.
+func httpRequestLabel(data []byte) string {
+	data = data[:min(len(data), maxRequestLine)]
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(data[:end]))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return ""
+	}
+	label := fields[0] + " " + fields[1]
+	if !printable(label) {
+		return ""
+	}
+	if len(label) > maxLabelLength {
+		label = label[:maxLabelLength-3] + "..."
+	}
+	return label
+}
+
+// printable reports whether s consists of printable ASCII characters only, so it can be logged without letting clients
+// forge log lines or send terminal escape sequences.
+func printable(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r < ' ' || r > '~' }) < 0
+}
+
+// validHostName reports whether name looks like a DNS host name: letters, digits, hyphens, underscores and dots, and
+// at most maxHostName bytes.
+func validHostName(name string) bool {
+	return name != "" && len(name) <= maxHostName && strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' ||
+			r == '.')
+	}) < 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// receiveBuffer returns the size of the receive buffer of conn.
+func receiveBuffer(t *testing.T, conn *net.TCPConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return size
+}
+
+func TestSetTcpConnBuffersAboveMaximum(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tcpConn := conn.(*net.TCPConn)
+
+	// far above kern.ipc.maxsockbuf, which macOS rejects rather than capping the size like Linux
+	const size = 1 << 30
+	if err := tcpConn.SetReadBuffer(size); err == nil {
+		t.Skip("the system accepts a receive buffer of 1 GiB")
+	}
+	before := receiveBuffer(t, tcpConn)
+	setTcpConnBuffers(tcpConn, size)
+	if after := receiveBuffer(t, tcpConn); after <= before {
+		t.Errorf("receive buffer of %d bytes after setting %d, %d before", after, size, before)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetSocketBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		size, max int // the largest size accepted, like kern.ipc.maxsockbuf on macOS
+		want      int
+	}{
+		{"accepted", 1 << 20, 8 << 20, 1 << 20},
+		{"halved", 64 << 20, 5 << 20, 4 << 20},
+		{"halved to the minimum", 64 << 20, minSocketBuffer, minSocketBuffer},
+		{"rejected", 64 << 20, minSocketBuffer - 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tried []int
+			got := setSocketBuffer(func(size int) error {
+				tried = append(tried, size)
+				if size > test.max {
+					return os.NewSyscallError("setsockopt", syscall.ENOBUFS)
+				}
+				return nil
+			}, test.size)
+			if got != test.want {
+				t.Errorf("set %d, want %d, tried %v", got, test.want, tried)
+			}
+			for _, size := range tried {
+				if size < minSocketBuffer {
+					t.Errorf("tried %d below the minimum %d", size, minSocketBuffer)
+				}
+			}
+		})
+	}
+}
+
+func TestResetMigratingConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	migrating := newMigratingConn(dialed.(*net.TCPConn), false)
+	if conn, ok := tcpConnOf(migrating); !ok || conn != dialed {
+		t.Fatalf("tcpConnOf = %v, %t, want the current connection", conn, ok)
+	}
+	// -kill-with rst and -idle-reset reset the upstream, which the peer has to see as a RST rather than a FIN
+	reset(migrating)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("peer read %v, want %v", err, syscall.ECONNRESET)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// socksTimeout bounds the SOCKS5 negotiation with a client, see readSOCKSRequest.
+const socksTimeout = 10 * time.Second
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0x00
+	socksNoMethods   = 0xff
+	socksConnect     = 0x01
+	socksIPv4        = 0x01
+	socksDomain      = 0x03
+	socksIPv6        = 0x04
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksUnreachable = 0x04
+	socksRefused     = 0x05
+	socksUnsupported = 0x07
+	socksBadAddrType = 0x08
+)
+
+// readSOCKSRequest negotiates with a SOCKS5 client, which may not use authentication, and returns the address its
+// CONNECT request asks for as host:port. Requests for other commands are answered with an error. If conn supports
+// deadlines, the negotiation times out after socksTimeout.
+func readSOCKSRequest(conn endpoint) (string, error) {
+	deadliner, hasDeadline := conn.(interface{ SetReadDeadline(time.Time) error })
+	if hasDeadline {
+		if err := deadliner.SetReadDeadline(time.Now().Add(socksTimeout)); err != nil {
+			return "", err
+		}
+		defer deadliner.SetReadDeadline(time.Time{})
+	}
+
+	// greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoMethods)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoMethods {
+		return "", errors.New("the client requires authentication")
+	}
+
+	// request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+		if !validHostName(host) {
+			writeSOCKSReply(conn, socksFailure, nil)
+			return "", fmt.Errorf("invalid SOCKS domain %q", host)
+		}
+	default:
+		writeSOCKSReply(conn, socksBadAddrType, nil)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	if request[1] != socksConnect {
+		writeSOCKSReply(conn, socksUnsupported, nil)
+		return "", fmt.Errorf("unsupported SOCKS command %d for %s", request[1], address)
+	}
+	return address, nil
+}
+
+// writeSOCKSReply answers a SOCKS5 request with the reply code and the address the proxy connected from, which may be
+// nil, eg. for errors.
+func writeSOCKSReply(conn io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			copy(reply[4:8], ip)
+		} else {
+			reply = append(append(reply[:3], socksIPv6), addr.IP.To16()...)
+			reply = append(reply, 0, 0)
+		}
+		binary.BigEndian.PutUint16(reply[len(reply)-2:], uint16(addr.Port))
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksReplyCode maps an error dialing the destination to a SOCKS5 reply code.
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		return socksUnreachable
+	default:
+		return socksFailure
+	}
+}
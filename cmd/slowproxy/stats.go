@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registry keeps track of the open connections so their statistics can be exported.
+//
+// The statistics are designed to leave the copy loops unaffected: each pipe counts into its own atomics, see
+// pipeSample, and the exporters aggregate them periodically. The copy loops never take a lock for statistics; the
+// registry's lock is only taken when connections open and close and when the exporters take a snapshot.
+type registry struct {
+	nextID      uint64
+	throughputs *histogram[throughputKey] // achieved by closed connections, by listener and direction
+	teardowns   *histogram[string]        // time from the first side closing to the pair being torn down, by reason
+	reasons     *classCounter             // why connections ended, see connection.endedBy
+
+	mu           sync.Mutex
+	conns        map[uint64]*connection
+	closed       []*connection         // closed since the last snapshot, so their final samples are not lost
+	keepClosed   bool                  // whether an exporter takes snapshots, see keepClosedConns
+	closedTotals map[string]pipeSample // counters of all closed connections by direction
+}
+
+func newRegistry() *registry {
+	return &registry{conns: map[uint64]*connection{}, closedTotals: map[string]pipeSample{},
+		throughputs: newHistogram[throughputKey](throughputBuckets), teardowns: newHistogram[string](teardownBuckets),
+		reasons: newClassCounter()}
+}
+
+// add assigns c an id and registers it.
+func (r *registry) add(c *connection) {
+	c.id = atomic.AddUint64(&r.nextID, 1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.id] = c
+}
+
+// remove unregisters c once it is closed and records the throughput it achieved, why it ended and how long its
+// teardown took.
+func (r *registry) remove(c *connection) {
+	r.reasons.add(c.endReason())
+	if closed := c.firstClosed(); !closed.IsZero() {
+		r.teardowns.observe(c.endReason(), time.Since(closed).Seconds())
+	}
+	elapsed := time.Since(c.opened).Seconds()
+	for _, p := range []*pipe{c.up, c.down} {
+		if transferred := p.Transferred(); transferred > 0 {
+			r.throughputs.observe(throughputKey{c.listener, p.direction()}, float64(transferred)/elapsed)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+	if r.keepClosed && c.sampled {
+		r.closed = append(r.closed, c)
+	}
+	for _, p := range []*pipe{c.up, c.down} {
+		r.closedTotals[p.direction()] = r.closedTotals[p.direction()].add(p.sample())
+	}
+}
+
+// totals returns the counters of all connections so far, open and closed, by direction.
+func (r *registry) totals() map[string]pipeSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totals := make(map[string]pipeSample, 2)
+	for direction, sample := range r.closedTotals {
+		totals[direction] = sample
+	}
+	for _, c := range r.conns {
+		for _, p := range []*pipe{c.up, c.down} {
+			totals[p.direction()] = totals[p.direction()].add(p.sample())
+		}
+	}
+	return totals
+}
+
+// keepClosedConns keeps the sampled connections that close until the next snapshot from now on. Only exporters taking
+// snapshots periodically call it, as the connections would pile up otherwise.
+func (r *registry) keepClosedConns() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keepClosed = true
+}
+
+// snapshot returns the open connections and those closed since the previous snapshot, see keepClosedConns.
+func (r *registry) snapshot() []*connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*connection, 0, len(r.conns)+len(r.closed))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	conns = append(conns, r.closed...)
+	r.closed = nil
+	return conns
+}
+
+// open returns the open connections ordered by id.
+func (r *registry) open() []*connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*connection, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// noteConditions notes the conditions of all open connections after a runtime change, see connection.noteConditions.
+func (r *registry) noteConditions(cfg *config) {
+	for _, c := range r.open() {
+		c.noteConditions(cfg)
+	}
+}
+
+// lingering returns the open connections one side of which closed longer than -linger-alarm ago, plus -close-delay
+// as the close may be held back that long on purpose. A pair lingering half-closed usually means a copy loop that does
+// not notice the close, which would otherwise only show as a slow goroutine and descriptor leak.
+func (px *proxy) lingering() []*connection {
+	if px.cfg.lingerAlarm <= 0 {
+		return nil
+	}
+	var conns []*connection
+	for _, c := range px.conns.open() {
+		if closed := c.firstClosed(); !closed.IsZero() && time.Since(closed) > px.cfg.closeDelay+px.cfg.lingerAlarm {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// watchLingering logs a warning once for every connection that starts lingering, see lingering. It never returns.
+func (px *proxy) watchLingering() {
+	for range time.Tick(max(px.cfg.lingerAlarm/10, time.Second)) {
+		for _, c := range px.lingering() {
+			if atomic.CompareAndSwapUint32(&c.lingerWarned, 0, 1) {
+				log.Printf("WARNING: %s: still open %v after it was ended by %s, the pair may be leaking", c.name,
+					time.Since(c.firstClosed()).Round(time.Second), c.endReason())
+			}
+		}
+	}
+}
+
+// throughputBuckets are the upper bounds of the histogram buckets for achieved throughputs in bytes per second. A final
+// bucket catches everything faster.
+var throughputBuckets = []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8}
+
+// teardownBuckets are the upper bounds of the histogram buckets for teardown delays in seconds. A final bucket catches
+// everything slower.
+var teardownBuckets = []float64{0.001, 0.01, 0.1, 1, 10, 60}
+
+// throughputKey identifies the connections a histogram of achieved throughputs counts together.
+type throughputKey struct {
+	listener  string // the address the clients connected to, as given on the command line
+	direction string
+}
+
+// String describes the key, eg. ":8080 upstream".
+func (k throughputKey) String() string {
+	return k.listener + " " + k.direction
+}
+
+// sortedThroughputKeys returns the keys of counts ordered by listener, upstream before downstream.
+func sortedThroughputKeys(counts map[throughputKey][]uint64) []throughputKey {
+	keys := make([]throughputKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].listener != keys[j].listener {
+			return keys[i].listener < keys[j].listener
+		}
+		return keys[i].direction > keys[j].direction
+	})
+	return keys
+}
+
+// histogram counts observed values such as achieved throughputs per key, eg. per listener and direction.
+type histogram[K comparable] struct {
+	bounds []float64 // upper bounds of the buckets, without the final one
+
+	mu     sync.Mutex
+	counts map[K][]uint64 // by key, per bucket
+	sums   map[K]float64  // by key
+}
+
+func newHistogram[K comparable](bounds []float64) *histogram[K] {
+	return &histogram[K]{bounds: bounds, counts: map[K][]uint64{}, sums: map[K]float64{}}
+}
+
+func (h *histogram[K]) observe(key K, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := h.counts[key]
+	if counts == nil {
+		counts = make([]uint64, len(h.bounds)+1)
+		h.counts[key] = counts
+	}
+	i := sort.SearchFloat64s(h.bounds, value)
+	counts[i]++
+	h.sums[key] += value
+}
+
+// snapshot returns a copy of the counts per key and bucket.
+func (h *histogram[K]) snapshot() map[K][]uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[K][]uint64, len(h.counts))
+	for key, c := range h.counts {
+		counts[key] = append([]uint64(nil), c...)
+	}
+	return counts
+}
+
+// sum returns the sum of the values observed for key.
+func (h *histogram[K]) sum(key K) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sums[key]
+}
+
+// bucketLabel names the bucket with index i by its upper bound, eg. 100000, or +Inf for the final bucket.
+func (h *histogram[K]) bucketLabel(i int) string {
+	if i == len(h.bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+}
+
+// bucketLabels names all buckets, see bucketLabel.
+func (h *histogram[K]) bucketLabels() []string {
+	labels := make([]string, len(h.bounds)+1)
+	for i := range labels {
+		labels[i] = h.bucketLabel(i)
+	}
+	return labels
+}
+
+// classCounter counts events such as errors by class.
+type classCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newClassCounter() *classCounter {
+	return &classCounter{counts: map[string]uint64{}}
+}
+
+func (c *classCounter) add(class string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[class]++
+}
+
+// snapshot returns a copy of the counts.
+func (c *classCounter) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]uint64, len(c.counts))
+	for class, n := range c.counts {
+		counts[class] = n
+	}
+	return counts
+}
+
+// pipeSample is the state of a pipe's counters at the time of a sample.
+type pipeSample struct {
+	transferred int64
+	throttled   int64
+}
+
+// direction names the direction of the pipe: upstream or downstream.
+func (p *pipe) direction() string {
+	return p.Direction.String()
+}
+
+func (s pipeSample) add(other pipeSample) pipeSample {
+	return pipeSample{transferred: s.transferred + other.transferred, throttled: s.throttled + other.throttled}
+}
+
+func (p *pipe) sample() pipeSample {
+	return pipeSample{transferred: p.Transferred(), throttled: int64(p.Throttled())}
+}
+
+// exportInflux writes a sample per connection and direction every -influx-interval to the InfluxDB write endpoint in
+// -influx-url, for the fraction -sample-rate of the connections. Each sample covers the bytes transferred, the
+// achieved throughput and the time spent throttling during the window. The reasons connections ended for and the
+// accept and dial errors are written as running totals per class, along with the number of open file descriptors and
+// histograms of the throughput achieved by and the teardown delay of all connections closed so far. It never returns.
+func (px *proxy) exportInflux() {
+	cfg, conns := px.cfg, px.conns
+	client := &http.Client{Timeout: cfg.influxInterval}
+	previous := map[*pipe]pipeSample{}
+	last := time.Now()
+	conns.keepClosedConns()
+
+	for range time.Tick(cfg.influxInterval) {
+		now := time.Now()
+		window := now.Sub(last).Seconds()
+		last = now
+
+		var lines bytes.Buffer
+		current := map[*pipe]pipeSample{}
+		for _, c := range conns.snapshot() {
+			if !c.sampled {
+				continue
+			}
+			for _, p := range []*pipe{c.up, c.down} {
+				sample := p.sample()
+				current[p] = sample
+				delta := pipeSample{
+					transferred: sample.transferred - previous[p].transferred,
+					throttled:   sample.throttled - previous[p].throttled,
+				}
+				label := ""
+				if l := c.getLabel(); l != "" {
+					label = ",label=" + influxTag(l)
+				}
+				fmt.Fprintf(&lines, "slowproxy_connection,conn=%d,client=%s,direction=%s%s "+
+					"bytes=%di,throughput=%f,throttled=%f %d\n",
+					c.id, influxTag(c.name), p.direction(), label,
+					delta.transferred, float64(delta.transferred)/window, time.Duration(delta.throttled).Seconds(),
+					now.UnixNano())
+			}
+		}
+		// samples of closed connections are not needed anymore
+		previous = current
+
+		for key, counts := range conns.throughputs.snapshot() {
+			// cumulative like Prometheus histograms, so a bucket counts the connections up to its bound
+			var cumulative uint64
+			for i, n := range counts {
+				cumulative += n
+				fmt.Fprintf(&lines, "slowproxy_throughput,listener=%s,direction=%s,le=%s count=%di %d\n",
+					influxTag(key.listener), key.direction, conns.throughputs.bucketLabel(i), cumulative,
+					now.UnixNano())
+			}
+		}
+		for reason, counts := range conns.teardowns.snapshot() {
+			var cumulative uint64
+			for i, n := range counts {
+				cumulative += n
+				fmt.Fprintf(&lines, "slowproxy_teardown,listener=%s,reason=%s,le=%s count=%di %d\n",
+					influxTag(cfg.listen), influxTag(reason), conns.teardowns.bucketLabel(i), cumulative,
+					now.UnixNano())
+			}
+		}
+		fmt.Fprintf(&lines, "slowproxy_lingering,listener=%s count=%di %d\n", influxTag(cfg.listen),
+			len(px.lingering()), now.UnixNano())
+		if open, limit := openFiles(); open >= 0 {
+			fmt.Fprintf(&lines, "slowproxy_process fds=%di,fd_limit=%di %d\n", open, limit, now.UnixNano())
+		}
+		for class, n := range px.acceptErrors.snapshot() {
+			fmt.Fprintf(&lines, "slowproxy_accept_errors,class=%s count=%di %d\n", influxTag(class), n, now.UnixNano())
+		}
+		for reason, n := range conns.reasons.snapshot() {
+			fmt.Fprintf(&lines, "slowproxy_closed,reason=%s count=%di %d\n", influxTag(reason), n, now.UnixNano())
+		}
+		for class, n := range px.dialErrors.snapshot() {
+			fmt.Fprintf(&lines, "slowproxy_dial_errors,class=%s count=%di %d\n", influxTag(class), n, now.UnixNano())
+		}
+
+		if lines.Len() == 0 {
+			continue
+		}
+		if err := writeInflux(client, cfg.influxURL, cfg.influxToken, &lines); err != nil {
+			log.Printf("influx: %v", err)
+		}
+	}
+}
+
+// writeInflux posts line protocol data to url.
+func writeInflux(client *http.Client, url, token string, data *bytes.Buffer) error {
+	req, err := http.NewRequest(http.MethodPost, url, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// influxTag escapes a tag value for the line protocol.
+func influxTag(value string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(value)
+}
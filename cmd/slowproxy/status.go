@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// secretFlags are left out of the status page and redacted in the configuration file of the admin API, see configFile.
+var secretFlags = map[string]bool{"anonymize-salt": true, "influx-token": true}
+
+// statusPage lays out the status page.
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>slowproxy {{.Listen}}</title><meta http-equiv="refresh" content="5"></head>
+<body>
+<h1>slowproxy {{.Listen}}</h1>
+<p>Up since {{.Started.Format "2006-01-02 15:04:05"}}, {{.Open}} connections open.</p>
+<h2>Conditions</h2>
+<table>
+<tr><td>forward</td><td>{{.Forward}}</td></tr>
+<tr><td>throughput</td><td>{{.Throughput}}{{if .Paused}}, paused{{end}}</td></tr>
+<tr><td>latency</td><td>{{.Latency}}{{if .Jitter}}, jitter {{.Jitter}}{{end}}</td></tr>
+{{range .Settings}}<tr><td>-{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+<h2>Throughput achieved by closed connections</h2>
+<table>
+<tr><th>bytes/s up to</th>{{range .Buckets}}<th>{{.}}</th>{{end}}</tr>
+{{range $key, $counts := .Throughputs}}<tr><td>{{$key}}</td>{{range $counts}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Teardown after the first side closed</h2>
+<p>{{.Lingering}} connections lingering half-closed.</p>
+<table>
+<tr><th>seconds up to</th>{{range .TeardownBuckets}}<th>{{.}}</th>{{end}}</tr>
+{{range $reason, $counts := .Teardowns}}<tr><td>{{$reason}}</td>{{range $counts}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Closed connections</h2>
+<table>
+{{range $reason, $n := .Reasons}}<tr><td>{{$reason}}</td><td>{{$n}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Accept errors</h2>
+<table>
+{{range $class, $n := .AcceptErrors}}<tr><td>{{$class}}</td><td>{{$n}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Dial errors</h2>
+<table>
+{{range $class, $n := .DialErrors}}<tr><td>{{$class}}</td><td>{{$n}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveStatus serves a read-only status page with the configuration and aggregate statistics on listener, a stream of
+// throughput samples on /samples, see streamSamples, and metrics for Prometheus on /metrics. Unlike the interactive
+// commands it cannot change anything, and it leaves out secrets and clients, so it is safe to share.
+func (px *proxy) serveStatus(listener net.Listener) {
+	started := time.Now()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		type setting struct{ Name, Value string }
+		var settings []setting
+		flag.Visit(func(f *flag.Flag) {
+			if !secretFlags[f.Name] {
+				settings = append(settings, setting{f.Name, f.Value.String()})
+			}
+		})
+		latency, jitter := px.cfg.live.currentLatency()
+		forward := px.cfg.forward
+		if px.cfg.forwardExec != "" {
+			forward = "exec " + px.cfg.forwardExec
+		} else if px.cfg.forwardBuiltin != "" {
+			forward = "builtin " + px.cfg.forwardBuiltin
+		} else if px.cfg.socks5 {
+			forward = "socks5"
+		}
+
+		err := statusPage.Execute(w, map[string]interface{}{
+			"Listen":          px.cfg.listen,
+			"Forward":         forward,
+			"Started":         started,
+			"Open":            len(px.conns.open()),
+			"Throughput":      formatThroughput(px.cfg.live.currentThroughput()),
+			"Paused":          px.cfg.live.isPaused(),
+			"Latency":         latency,
+			"Jitter":          jitter,
+			"Settings":        settings,
+			"Buckets":         px.conns.throughputs.bucketLabels(),
+			"Throughputs":     throughputRows(px.conns.throughputs.snapshot()),
+			"TeardownBuckets": px.conns.teardowns.bucketLabels(),
+			"Teardowns":       px.conns.teardowns.snapshot(),
+			"Lingering":       len(px.lingering()),
+			"Reasons":         px.conns.reasons.snapshot(),
+			"AcceptErrors":    px.acceptErrors.snapshot(),
+			"DialErrors":      px.dialErrors.snapshot(),
+		})
+		if err != nil {
+			log.Printf("status: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/samples", px.streamSamples)
+	mux.HandleFunc("/metrics", px.serveMetrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(listener); err != nil {
+		log.Printf("status: %v", err)
+	}
+}
+
+// throughputRows keys the rows of the throughput histogram on the status page by listener and direction, eg.
+// ":8080 upstream".
+func throughputRows(counts map[throughputKey][]uint64) map[string][]uint64 {
+	rows := make(map[string][]uint64, len(counts))
+	for key, c := range counts {
+		rows[key.String()] = c
+	}
+	return rows
+}
+
+// sampleInterval is the interval of the samples streamed by streamSamples.
+const sampleInterval = time.Second
+
+// throughputSample is an event streamed by streamSamples, with throughputs in bytes per second. Connections are only
+// identified by their id, like on the status page.
+type throughputSample struct {
+	Time        time.Time          `json:"time"`
+	Up          float64            `json:"up"`
+	Down        float64            `json:"down"`
+	Listeners   []listenerSample   `json:"listeners"` // by address, eg. to tell the listeners of -route apart
+	Connections []connectionSample `json:"connections"`
+}
+
+// listenerSample aggregates the connections open on a listener.
+type listenerSample struct {
+	Listener    string  `json:"listener"` // the address as given on the command line
+	Up          float64 `json:"up"`
+	Down        float64 `json:"down"`
+	Connections int     `json:"connections"`
+}
+
+type connectionSample struct {
+	ID       uint64  `json:"id"`
+	Listener string  `json:"listener"`
+	Up       float64 `json:"up"`
+	Down     float64 `json:"down"`
+}
+
+// streamSamples streams the throughput achieved every second, in total, per listener and per open connection, as
+// server-sent events with a JSON throughputSample each, so dashboards can plot live graphs without polling.
+func (px *proxy) streamSamples(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+	previous := map[*pipe]pipeSample{}
+	last := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		window := now.Sub(last).Seconds()
+		last = now
+
+		sample := throughputSample{Time: now, Listeners: []listenerSample{}, Connections: []connectionSample{}}
+		current := map[*pipe]pipeSample{}
+		listeners := map[string]*listenerSample{}
+		for _, c := range px.conns.open() {
+			conn := connectionSample{ID: c.id, Listener: c.listener}
+			for _, p := range []*pipe{c.up, c.down} {
+				current[p] = p.sample()
+				throughput := float64(current[p].transferred-previous[p].transferred) / window
+				if p == c.up {
+					conn.Up = throughput
+				} else {
+					conn.Down = throughput
+				}
+			}
+			sample.Up += conn.Up
+			sample.Down += conn.Down
+			sample.Connections = append(sample.Connections, conn)
+			listener := listeners[c.listener]
+			if listener == nil {
+				listener = &listenerSample{Listener: c.listener}
+				listeners[c.listener] = listener
+			}
+			listener.Up += conn.Up
+			listener.Down += conn.Down
+			listener.Connections++
+		}
+		previous = current
+		for _, listener := range listeners {
+			sample.Listeners = append(sample.Listeners, *listener)
+		}
+		sort.Slice(sample.Listeners, func(i, j int) bool {
+			return sample.Listeners[i].Listener < sample.Listeners[j].Listener
+		})
+
+		data, err := json.Marshal(sample)
+		if err != nil {
+			log.Printf("status: %v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
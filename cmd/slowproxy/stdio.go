@@ -0,0 +1,33 @@
+package main
+
+import "os"
+
+// stdioConn is the endpoint for stdin and stdout, which turns slowproxy into a throttled netcat, eg. for use as an SSH
+// ProxyCommand.
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdioConn) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdioConn) CloseRead() error {
+	return os.Stdin.Close()
+}
+
+func (stdioConn) CloseWrite() error {
+	return os.Stdout.Close()
+}
+
+func (c stdioConn) Close() error {
+	c.CloseRead()
+	return c.CloseWrite()
+}
+
+// String identifies stdin/stdout in logs.
+func (stdioConn) String() string {
+	return "stdio"
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// tenantTimeout is how long to wait for the line naming the tenant with -tenant.
+const tenantTimeout = 5 * time.Second
+
+// maxTenantLine limits the length of the line naming the tenant.
+const maxTenantLine = 256
+
+// readTenant reads the first line sent by the client, which names the tenant the connection is for, and returns the
+// tenant's route. The line is stripped, so the upstream only sees what follows. An empty line selects FORWARD and
+// THROUGHPUT, other names without a route are rejected.
+func (cfg *config) readTenant(conn io.Reader) (string, route, error) {
+	line, err := readLine(conn, tenantTimeout, maxTenantLine)
+	if err != nil {
+		return "", route{}, err
+	}
+	name := strings.ToLower(strings.TrimSpace(line))
+	if name == "" {
+		return "", route{forward: cfg.forward}, nil
+	}
+	r, ok := cfg.tenants[name]
+	if !ok {
+		return name, route{}, fmt.Errorf("unknown tenant %q", name)
+	}
+	return name, r, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsListener terminates TLS on the connections accepted by a listener, so the proxy can shape HTTPS services and
+// forward plaintext to them.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+// newTLSListener wraps listener to terminate TLS with the certificate and key in the PEM files certFile and keyFile. If
+// clientCAFile is not empty, clients have to present a certificate signed by one of the CA certificates in it.
+func newTLSListener(listener net.Listener, certFile, keyFile, clientCAFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tlsListener{Listener: listener, config: config}, nil
+}
+
+// Accept accepts the next connection. The handshake is left to handle, so a slow client does not hold up accepting
+// others.
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsConn{tls.Server(conn, l.config)}, nil
+}
+
+// tlsConn is a TLS connection usable as an endpoint.
+type tlsConn struct {
+	*tls.Conn
+}
+
+// CloseRead shuts down reading on the underlying connection, TLS itself has no way of closing a single direction.
+func (c *tlsConn) CloseRead() error {
+	if conn, ok := c.NetConn().(interface{ CloseRead() error }); ok {
+		return conn.CloseRead()
+	}
+	return nil
+}
+
+// tcpConnOf returns the TCP connection underlying e, if there is one. For an upstream that migrates or reconnects, it
+// is the one underlying the current connection, none during a gap.
+func tcpConnOf(e endpoint) (*net.TCPConn, bool) {
+	if c, ok := e.(*migratingConn); ok {
+		c.mu.Lock()
+		current := c.current
+		c.mu.Unlock()
+		if current == nil {
+			return nil, false
+		}
+		return tcpConnOf(current)
+	}
+	if c, ok := e.(*peekedConn); ok {
+		e = c.endpoint
+	}
+	if proxied, ok := proxiedConnOf(e); ok {
+		conn, ok := proxied.Conn.(*net.TCPConn)
+		return conn, ok
+	}
+	if c, ok := e.(*tlsConn); ok {
+		conn, ok := c.NetConn().(*net.TCPConn)
+		return conn, ok
+	}
+	conn, ok := e.(*net.TCPConn)
+	return conn, ok
+}
+
+// tlsHandshakeTimeout bounds TLS handshakes with clients and the upstream.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshake performs the TLS handshake, which verifies the client's certificate if required, within
+// tlsHandshakeTimeout.
+func (c *tlsConn) handshake() error {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return c.HandshakeContext(ctx)
+}
+
+// newUpstreamTLSConfig configures TLS towards the forward address. The certificate is verified for serverName, or the
+// host of forward if it is empty, with the CA certificates in the PEM file caFile, or the system's if it is empty.
+// With insecure, the certificate is not verified at all.
+func newUpstreamTLSConfig(forward, serverName, caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+	if serverName == "" {
+		if host, _, err := net.SplitHostPort(forward); err == nil {
+			config.ServerName = host
+		}
+	}
+	if caFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// loadCertPool loads the CA certificates in the PEM file path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// startUpstreamTLS performs the TLS handshake on conn to the upstream, so failures show up as dial errors. It also
+// returns the name identifying the upstream in logs.
+func startUpstreamTLS(conn net.Conn, config *tls.Config) (endpoint, string, error) {
+	secured := &tlsConn{tls.Client(conn, config)}
+	if err := secured.handshake(); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("%s: %w", conn.RemoteAddr(), err)
+	}
+	return secured, conn.RemoteAddr().String(), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// udpQueueLength is the number of datagrams from a client that can wait for the throughput. Further ones are dropped,
+// like by a router with a full queue.
+const udpQueueLength = 64
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+// minUDPBackoff and maxUDPBackoff bound the pause after reading a datagram fails, so that a persistent error is not
+// retried in a tight loop. The pause doubles with every consecutive failure.
+const (
+	minUDPBackoff = 5 * time.Millisecond
+	maxUDPBackoff = time.Second
+)
+
+// udpSession relays the datagrams between a client address and the forward address.
+type udpSession struct {
+	name         string // identifies the client in logs
+	client       net.Addr
+	upstream     *net.UDPConn  // connected to the forward address, so the replies can be told apart by session
+	queue        chan []byte   // datagrams from the client waiting for the throughput
+	lastActivity int64         // time of the last datagram in either direction, see sinceStart, accessed atomically
+	idleTimeout  time.Duration // the session ends after being idle for this long
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActivity, sinceStart(time.Now()))
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Duration(sinceStart(time.Now()) - atomic.LoadInt64(&s.lastActivity))
+}
+
+// serveUDP relays datagrams between the clients sending to conn and the forward address, with a session per client
+// address that ends once it has been idle for -udp-idle-timeout. Datagrams are never split, so the throughput is
+// paced per datagram, and the latency delays each datagram without holding up the following ones. Like connections,
+// sessions count towards -max-conns and -max-memory: the datagrams of new clients beyond them are dropped. It returns
+// once conn is closed.
+func (px *proxy) serveUDP(conn net.PacketConn) {
+	var mu sync.Mutex // guards sessions and sending to their queues
+	sessions := map[string]*udpSession{}
+	buf := make([]byte, maxDatagramSize)
+	var backoff time.Duration
+	rejecting := false
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			backoff = udpBackoff("udp", err, backoff)
+			continue
+		}
+		backoff = 0
+
+		mu.Lock()
+		key := addr.String()
+		s := sessions[key]
+		if s == nil {
+			if reason := px.overloaded(); reason != "" {
+				mu.Unlock()
+				// only the first of a series is logged, a flood of new clients would flood the log as well
+				if !rejecting {
+					log.Printf("%s: rejected, %s", px.cfg.clientName(addr), reason)
+					rejecting = true
+				}
+				continue
+			}
+			rejecting = false
+			s, err = px.openUDPSession(addr)
+			if err != nil {
+				mu.Unlock()
+				px.dialErrors.add(errorClass(err))
+				log.Printf("unable to dial: %v", err)
+				continue
+			}
+			sessions[key] = s
+			atomic.AddInt64(&px.active, 1)
+			go px.relayUDPUp(s)
+			go func() {
+				px.relayUDPDown(s, conn)
+				mu.Lock()
+				delete(sessions, key)
+				close(s.queue)
+				mu.Unlock()
+				s.upstream.Close()
+				atomic.AddInt64(&px.active, -1)
+				log.Printf("%s: udp session expired after %v idle", s.name, s.idleTimeout)
+			}()
+		}
+		s.touch()
+		select {
+		case s.queue <- append([]byte(nil), buf[:n]...):
+		default:
+			// the client sends faster than the throughput allows for long enough to fill the queue
+		}
+		mu.Unlock()
+	}
+}
+
+// openUDPSession connects to the forward address for a new client.
+func (px *proxy) openUDPSession(client net.Addr) (*udpSession, error) {
+	conn, err := net.Dial("udp", px.cfg.forward)
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{name: px.cfg.clientName(client), client: client, upstream: conn.(*net.UDPConn),
+		queue: make(chan []byte, udpQueueLength), idleTimeout: px.cfg.udpIdleTimeout}
+	log.Printf("%s: udp session open", s.name)
+	return s, nil
+}
+
+// relayUDPUp forwards the datagrams queued by the client to the upstream until the queue is closed.
+func (px *proxy) relayUDPUp(s *udpSession) {
+	var pace pacer.Pacer
+	blackhole := px.cfg.blackholeFor("upstream")
+	for datagram := range s.queue {
+		if blackhole > 0 && len(datagram) > blackhole {
+			continue
+		}
+		px.cfg.live.waitWhilePaused()
+		throughput, _ := px.cfg.live.currentThroughput()
+		start := time.Now()
+		if px.sharedUp != nil {
+			px.sharedUp.Wait(throughput, len(datagram))
+		}
+		px.sendLater(datagram, func(d []byte) error {
+			_, err := s.upstream.Write(d)
+			return err
+		}, s.name)
+		if px.sharedUp == nil {
+			pace.Delay(throughput, len(datagram), start)
+		}
+	}
+}
+
+// relayUDPDown forwards the upstream's datagrams to the client through conn until the session has been idle for its
+// idle timeout.
+func (px *proxy) relayUDPDown(s *udpSession, conn net.PacketConn) {
+	var pace pacer.Pacer
+	blackhole := px.cfg.blackholeFor("downstream")
+	buf := make([]byte, maxDatagramSize)
+	var backoff time.Duration
+	for {
+		s.upstream.SetReadDeadline(time.Now().Add(s.idleTimeout - s.idle()))
+		n, err := s.upstream.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if s.idle() >= s.idleTimeout {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			// eg. ECONNREFUSED after an ICMP port unreachable, the upstream may still come up
+			backoff = udpBackoff(s.upstream.RemoteAddr().String(), err, backoff)
+			continue
+		}
+		backoff = 0
+		s.touch()
+		if blackhole > 0 && n > blackhole {
+			continue
+		}
+
+		px.cfg.live.waitWhilePaused()
+		_, throughput := px.cfg.live.currentThroughput()
+		start := time.Now()
+		if px.sharedDown != nil {
+			px.sharedDown.Wait(throughput, n)
+		}
+		px.sendLater(append([]byte(nil), buf[:n]...), func(d []byte) error {
+			_, err := conn.WriteTo(d, s.client)
+			return err
+		}, s.name)
+		if px.sharedDown == nil {
+			pace.Delay(throughput, n, start)
+		}
+	}
+}
+
+// udpBackoff pauses after err reading datagrams from name, for longer than the previous pause backoff, and returns the
+// pause. Only the first error of a series is logged.
+func udpBackoff(name string, err error, backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		log.Printf("%s: %v", name, err)
+	}
+	backoff = min(max(2*backoff, minUDPBackoff), maxUDPBackoff)
+	time.Sleep(backoff)
+	return backoff
+}
+
+// sendLater sends datagram with send after the latency of the current conditions, or right away without latency.
+// Failures are logged with name.
+func (px *proxy) sendLater(datagram []byte, send func([]byte) error, name string) {
+	deliver := func() {
+		if err := send(datagram); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if latency := px.cfg.chunkLatency(); latency > 0 {
+		time.AfterFunc(latency, deliver)
+		return
+	}
+	deliver()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// udpEcho starts an upstream that sends every datagram back and returns its address.
+func udpEcho(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// udpProxy starts a UDP proxy to forward with cfg and returns a client connected to it.
+func udpProxy(t *testing.T, cfg *config) *net.UDPConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	cfg.live.setThroughput(10_000_000, 10_000_000)
+	go newProxy(cfg, nil).serveUDP(conn)
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client.(*net.UDPConn)
+}
+
+func TestUDPBlackhole(t *testing.T) {
+	client := udpProxy(t, &config{forward: udpEcho(t), udpIdleTimeout: time.Minute, blackholeAbove: 100,
+		blackholeDirection: "upstream"})
+	small, large := bytes.Repeat([]byte("s"), 50), bytes.Repeat([]byte("l"), 200)
+	// unlike a TCP stream, the datagrams after the large one still pass
+	for _, datagram := range [][]byte{small, large, small} {
+		client.Write(datagram)
+	}
+	buf := make([]byte, maxDatagramSize)
+	for i := 0; i < 2; i++ {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], small) {
+			t.Fatalf("datagram %d: received %d bytes: %v, want the small one", i, n, err)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("received %d bytes: %v, want the large datagram dropped", n, err)
+	}
+}
+
+func TestUDPMaxConns(t *testing.T) {
+	cfg := &config{forward: udpEcho(t), udpIdleTimeout: time.Minute, maxConns: 1}
+	first := udpProxy(t, cfg)
+	second, err := net.DialUDP("udp", nil, first.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for _, client := range []*net.UDPConn{first, second} {
+		client.Write([]byte("ping"))
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := client.Read(buf)
+		switch {
+		case client == first && (err != nil || string(buf[:n]) != "ping"):
+			t.Errorf("first client received %q: %v, want its session", buf[:n], err)
+		case client == second && !errors.Is(err, os.ErrDeadlineExceeded):
+			t.Errorf("second client received %q: %v, want no session beyond -max-conns", buf[:n], err)
+		}
+	}
+}
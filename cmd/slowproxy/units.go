@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseThroughput parses a throughput in bytes per second. Besides plain numbers it understands SI and binary prefixes
+// and bits, with an optional "/s" or "ps" suffix, eg. 512k, 2M, 100KB/s or 64KiB for bytes per second and 1.5Mbit,
+// 3Mb/s or 10Mbps for bits per second. A lowercase b stands for bits and an uppercase B for bytes. The result is
+// rounded to whole bytes per second.
+func parseThroughput(s string) (int, error) {
+	unit := strings.TrimLeft(s, "0123456789.")
+	number, err := strconv.ParseFloat(s[:len(s)-len(unit)], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a throughput", s)
+	}
+
+	rest := strings.TrimSuffix(unit, "/s")
+	if rest == unit && strings.HasSuffix(rest, "ps") {
+		rest = strings.TrimSuffix(rest, "ps")
+	}
+
+	multiplier := 1.0
+	if rest != "" {
+		if i := strings.IndexByte("kKMG", rest[0]); i >= 0 {
+			prefix := []float64{1e3, 1e3, 1e6, 1e9}[i]
+			rest = rest[1:]
+			if strings.HasPrefix(rest, "i") {
+				prefix = []float64{1 << 10, 1 << 10, 1 << 20, 1 << 30}[i]
+				rest = rest[1:]
+			}
+			multiplier = prefix
+		}
+	}
+	switch rest {
+	case "", "B":
+	case "b", "bit":
+		multiplier /= 8
+	default:
+		return 0, fmt.Errorf("%s has an unknown unit, eg. 512k, 100KB/s or 1.5Mbit are valid throughputs", s)
+	}
+
+	throughput := math.Round(number * multiplier)
+	if throughput > math.MaxInt32 {
+		return 0, fmt.Errorf("%s is too high a throughput", s)
+	}
+	return int(throughput), nil
+}
+
+// throughputValue is a flag.Value for throughputs in the notations understood by parseThroughput.
+type throughputValue int
+
+func (v *throughputValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *throughputValue) Set(s string) error {
+	throughput, err := parseThroughput(s)
+	if err != nil {
+		return err
+	}
+	*v = throughputValue(throughput)
+	return nil
+}
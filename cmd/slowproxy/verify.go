@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// verifyPings is the number of round trips the latency check measures, the median of which is compared.
+const verifyPings = 7
+
+// verifySlack is added to the tolerance of the latency check, for the scheduling overhead of sleeping.
+const verifySlack = 5 * time.Millisecond
+
+// verifyBlackhole is the size above which the proxy of the blackhole check stalls chunks, see -blackhole-above.
+const verifyBlackhole = 1024
+
+// verifyReport is the machine-readable result of slowproxy verify.
+type verifyReport struct {
+	Host       string        `json:"host"`
+	Time       time.Time     `json:"time"`
+	Throughput int           `json:"throughput"` // bytes per second
+	LatencyMs  float64       `json:"latency_ms"`
+	Tolerance  float64       `json:"tolerance_percent"`
+	Passed     bool          `json:"passed"`
+	Checks     []verifyCheck `json:"checks"`
+}
+
+// verifyCheck is the outcome of one check of slowproxy verify.
+type verifyCheck struct {
+	Name     string  `json:"name"`
+	Passed   bool    `json:"passed"`
+	Expected float64 `json:"expected"`
+	Measured float64 `json:"measured"`
+	Unit     string  `json:"unit"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// runVerify implements slowproxy verify: it runs a proxy and a test upstream in-process on the loopback interface and
+// checks that the throughput in both directions and the latency are within the tolerance of what was configured, that
+// closing either side passes on all data before the close, and that none of a chunk above -blackhole-above gets
+// through. The report is written to stdout as JSON. It returns the exit code: 0 if all checks passed, 1 if any failed
+// and 2 for invalid arguments.
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	throughput := 1000000
+	flags.Var((*throughputValue)(&throughput), "throughput", "`throughput` to verify, eg. 512k")
+	latency := flags.Duration("latency", 20*time.Millisecond, "latency to verify")
+	duration := flags.Duration("duration", 3*time.Second, "how long each throughput check transfers data")
+	tolerance := flags.Float64("tolerance", 10, "maximum deviation from the configured conditions in percent")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [OPTIONS]\n\nOptions:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if throughput <= 0 || *latency < 0 || *duration < time.Second || *tolerance <= 0 {
+		fmt.Fprintln(os.Stderr, "-throughput and -tolerance must be positive, -latency not negative and -duration "+
+			"at least 1s")
+		return 2
+	}
+	// the connections of the checks are of no interest
+	log.SetOutput(io.Discard)
+
+	report := verifyReport{Time: time.Now(), Throughput: throughput, LatencyMs: ms(*latency), Tolerance: *tolerance,
+		Passed: true}
+	report.Host, _ = os.Hostname()
+	addr, err := startVerifyProxy(throughput, *latency, 0)
+	var blackholeAddr string
+	if err == nil {
+		blackholeAddr, err = startVerifyProxy(throughput, *latency, verifyBlackhole)
+	}
+	if err != nil {
+		report.Passed = false
+		report.Checks = append(report.Checks, verifyCheck{Name: "setup", Error: err.Error()})
+	} else {
+		size := int(float64(throughput) * duration.Seconds())
+		within := func(expected, measured, slack float64) bool {
+			return math.Abs(measured-expected) <= expected**tolerance/100+slack
+		}
+
+		check := verifyCheck{Name: "throughput-down", Expected: float64(throughput), Unit: "bytes/s"}
+		if elapsed, err := verifyDownload(addr, size); err != nil {
+			check.Error = err.Error()
+		} else {
+			check.Measured = float64(size) / elapsed.Seconds()
+			check.Passed = within(check.Expected, check.Measured, 0)
+		}
+		report.Checks = append(report.Checks, check)
+
+		check = verifyCheck{Name: "throughput-up", Expected: float64(throughput), Unit: "bytes/s"}
+		if elapsed, err := verifyUpload(addr, size); err != nil {
+			check.Error = err.Error()
+		} else {
+			check.Measured = float64(size) / elapsed.Seconds()
+			check.Passed = within(check.Expected, check.Measured, 0)
+		}
+		report.Checks = append(report.Checks, check)
+
+		// every chunk is delayed once in each direction
+		check = verifyCheck{Name: "latency-rtt", Expected: ms(2 * *latency), Unit: "ms"}
+		if rtt, err := verifyRoundTrip(addr); err != nil {
+			check.Error = err.Error()
+		} else {
+			check.Measured = ms(rtt)
+			check.Passed = within(check.Expected, check.Measured, ms(verifySlack))
+		}
+		report.Checks = append(report.Checks, check)
+
+		small := max(throughput/10, 1)
+		for _, c := range []struct {
+			name   string
+			verify func(string, int) (time.Duration, error)
+		}{{"close-client-first", verifyUpload}, {"close-upstream-first", verifyDownload}} {
+			check := verifyCheck{Name: c.name, Expected: float64(small), Unit: "bytes"}
+			if _, err := c.verify(addr, small); err != nil {
+				check.Error = err.Error()
+			} else {
+				check.Measured, check.Passed = float64(small), true
+			}
+			report.Checks = append(report.Checks, check)
+		}
+
+		// the loss at the blackhole is complete, nothing of a larger chunk may arrive
+		check = verifyCheck{Name: "blackhole", Expected: 0, Unit: "bytes"}
+		if n, err := verifyBlackholeLoss(blackholeAddr, 2**latency+verifyBlackholeWait); err != nil {
+			check.Error = err.Error()
+		} else {
+			check.Measured, check.Passed = float64(n), n == 0
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	for _, check := range report.Checks {
+		report.Passed = report.Passed && check.Passed
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(report)
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
+
+// ms converts d to fractional milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// startVerifyProxy starts a test upstream and a proxy to it with the throughput, latency and blackhole size, 0 for
+// none, on the loopback interface and returns the proxy's address. All other options have their defaults.
+//
+// The test upstream expects a command byte and a big-endian 64 bit size from each client. For 'd' it sends size bytes
+// and closes the connection. For 'u' it reads until the client closes its side, replies with the number of bytes read
+// and closes. For 'e' it echoes every byte.
+func startVerifyProxy(throughput int, latency time.Duration, blackhole int) (string, error) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go serveVerifyUpstream(conn)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	cfg := &config{}
+	defineFlags(flag.NewFlagSet("verify", flag.ContinueOnError), cfg, &flagValues{})
+	cfg.listen, cfg.forward = listener.Addr().String(), upstream.Addr().String()
+	cfg.throughput, cfg.upThroughput, cfg.downThroughput = throughput, throughput, throughput
+	cfg.latency, cfg.blackholeAbove = latency, blackhole
+	cfg.live.setThroughput(throughput, throughput)
+	cfg.live.setLatency(latency, 0)
+	var shuttingDown uint32
+	go newProxy(cfg, nil).serve(listener, cfg.listen, &shuttingDown, "", nil)
+	return listener.Addr().String(), nil
+}
+
+func serveVerifyUpstream(conn net.Conn) {
+	defer conn.Close()
+	request := make([]byte, 9)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	size := int64(binary.BigEndian.Uint64(request[1:]))
+	switch request[0] {
+	case 'd':
+		io.CopyN(conn, zeroReader{}, size)
+	case 'u':
+		n, err := io.Copy(io.Discard, conn)
+		if err != nil {
+			return
+		}
+		binary.Write(conn, binary.BigEndian, n)
+	case 'e':
+		io.Copy(conn, conn)
+	}
+}
+
+// zeroReader reads endless zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// verifyRequest connects to the proxy at addr and sends the command and size for the test upstream.
+func verifyRequest(addr string, command byte, size int) (*net.TCPConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	request := make([]byte, 9)
+	request[0] = command
+	binary.BigEndian.PutUint64(request[1:], uint64(size))
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// verifyDownload has the upstream send size bytes and close, and returns how long it took until the client received
+// all of them and the close.
+func verifyDownload(addr string, size int) (time.Duration, error) {
+	conn, err := verifyRequest(addr, 'd', size)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil {
+		return 0, err
+	}
+	if n != int64(size) {
+		return 0, fmt.Errorf("received %d of %d bytes before the close", n, size)
+	}
+	return time.Since(start), nil
+}
+
+// verifyUpload sends size bytes to the upstream and closes the client's side, and returns how long it took until the
+// upstream confirmed receiving all of them and closed in turn.
+func verifyUpload(addr string, size int) (time.Duration, error) {
+	conn, err := verifyRequest(addr, 'u', size)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := io.CopyN(conn, zeroReader{}, int64(size)); err != nil {
+		return 0, err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return 0, err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) != 8 {
+		return 0, fmt.Errorf("unexpected reply %q from the upstream", reply)
+	}
+	if n := int64(binary.BigEndian.Uint64(reply)); n != int64(size) {
+		return 0, fmt.Errorf("the upstream received %d of %d bytes before the close", n, size)
+	}
+	return time.Since(start), nil
+}
+
+// verifyBlackholeWait is how long the blackhole check waits for data that should not arrive, on top of the latency.
+const verifyBlackholeWait = 500 * time.Millisecond
+
+// verifyBlackholeLoss sends a byte and then a chunk of four times verifyBlackhole through the proxy at addr, which
+// stalls chunks above verifyBlackhole, and an echoing upstream. It returns how many bytes of the chunk came back
+// within wait, which should be none, while the byte has to come back.
+func verifyBlackholeLoss(addr string, wait time.Duration) (int, error) {
+	conn, err := verifyRequest(addr, 'e', 0)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetNoDelay(true)
+	b := []byte{'x'}
+	if _, err := conn.Write(b); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return 0, fmt.Errorf("a byte below the blackhole: %v", err)
+	}
+	chunk := make([]byte, 4*verifyBlackhole)
+	if _, err := conn.Write(chunk); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	n, err := io.ReadFull(conn, chunk)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, err
+	}
+	return n, nil
+}
+
+// verifyRoundTrip measures the round-trip time of single bytes through the proxy and an echoing upstream, and returns
+// the median of verifyPings measurements.
+func verifyRoundTrip(addr string) (time.Duration, error) {
+	conn, err := verifyRequest(addr, 'e', 0)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetNoDelay(true)
+	rtts := make([]time.Duration, verifyPings)
+	b := []byte{'x'}
+	for i := range rtts {
+		start := time.Now()
+		if _, err := conn.Write(b); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(b, []byte{'x'}) {
+			return 0, fmt.Errorf("unexpected echo %q", b)
+		}
+		rtts[i] = time.Since(start)
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[len(rtts)/2], nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// clampWindow limits the receive window conn advertises to its peer to clamp bytes with TCP_WINDOW_CLAMP, so the peer
+// is held back by flow control instead of by the proxy's pacing. The kernel enforces a minimum of a few kilobytes.
+func clampWindow(conn *net.TCPConn, clamp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_WINDOW_CLAMP, clamp)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
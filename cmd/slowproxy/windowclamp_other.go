@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// clampWindow fails since TCP_WINDOW_CLAMP is only supported on Linux.
+func clampWindow(conn *net.TCPConn, clamp int) error {
+	return errors.New("TCP_WINDOW_CLAMP is not supported on this platform")
+}
@@ -0,0 +1,41 @@
+package slowproxy
+
+import (
+	"io"
+	"net"
+)
+
+// ThrottledConn limits the throughput of reading from and of writing to a connection, each to the same number of
+// bytes per second, eg. to slow down one end of a connection in a test without a proxy in between.
+type ThrottledConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+// NewThrottledConn wraps conn to read and write at most bytesPerSec bytes per second each, like NewReader and
+// NewWriter. A bytesPerSec of 0 does not limit the throughput.
+func NewThrottledConn(conn net.Conn, bytesPerSec int) *ThrottledConn {
+	rate := Rate(bytesPerSec)
+	return &ThrottledConn{Conn: conn, r: NewReader(conn, rate), w: NewWriter(conn, rate)}
+}
+
+// Read reads at most one second worth of data and returns once the throughput allows for it.
+func (c *ThrottledConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write writes p in chunks of at most one second worth of data and returns once the throughput allows for the last
+// one.
+func (c *ThrottledConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// CloseWrite closes the writing side of the connection if it supports closing a single direction, eg. TCP, and
+// closes the connection otherwise.
+func (c *ThrottledConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,3 @@
+module github.com/dmiruke/slowproxy
+
+go 1.21
@@ -0,0 +1,170 @@
+// Package admin serves the admin API of a running proxy, which changes its conditions like the interactive commands
+// of the slowproxy command:
+//
+//	GET  /conditions   the current conditions as JSON
+//	POST /conditions   change the conditions given as form values: throughput, up, down, latency, jitter or paused,
+//	                   eg. throughput=512k&latency=40ms, and return the resulting conditions
+//	GET  /connections  the open connections as JSON
+//	GET  /config       a configuration file for -config that starts a proxy with the current conditions
+//
+// The API has no authentication, so it should only listen on addresses trusted users can reach.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Conditions is the representation of the current conditions in the API.
+type Conditions struct {
+	Up      int    `json:"up"`   // bytes per second towards the upstream
+	Down    int    `json:"down"` // bytes per second towards the client
+	Latency string `json:"latency"`
+	Jitter  string `json:"jitter"`
+	Paused  bool   `json:"paused"`
+}
+
+// Connection is the representation of an open connection in the API.
+type Connection struct {
+	ID         uint64    `json:"id"`
+	Client     string    `json:"client"`
+	Upstream   string    `json:"upstream"`
+	Label      string    `json:"label,omitempty"`
+	Opened     time.Time `json:"opened"`
+	Up         int64     `json:"up"`   // bytes transferred towards the upstream
+	Down       int64     `json:"down"` // bytes transferred towards the client
+	Conditions string    `json:"conditions"`
+}
+
+// Change is a valid change of the conditions requested through the API. Conditions that are nil stay as they are.
+type Change struct {
+	Up, Down        *int // bytes per second, at least 1
+	Latency, Jitter *time.Duration
+	Paused          *bool
+}
+
+// Proxy is the running proxy the API controls.
+type Proxy interface {
+	Conditions() Conditions
+	Connections() []Connection
+	// Change applies change, requested by who, eg. the IP address of the client of the API.
+	Change(who string, change Change)
+	// Config returns a configuration file, as read by the -config option of the slowproxy command, that starts a
+	// proxy with the current conditions.
+	Config() []byte
+}
+
+// Serve serves the API for p on listener until it is closed. parseThroughput parses the throughputs in the form values
+// like on the command line, eg. 512k.
+func Serve(listener net.Listener, p Proxy, parseThroughput func(string) (int, error)) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conditions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			change, err := parseChange(r.PostForm, parseThroughput)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			who := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(who); err == nil {
+				who = host
+			}
+			p.Change(who, change)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, p.Conditions())
+	})
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		conns := p.Connections()
+		if conns == nil {
+			conns = []Connection{}
+		}
+		writeJSON(w, conns)
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(p.Config())
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return server.Serve(listener)
+}
+
+// parseChange parses the change requested by form. Nothing is changed if any of the values is invalid.
+func parseChange(form url.Values, parseThroughput func(string) (int, error)) (Change, error) {
+	var change Change
+	for _, name := range []string{"throughput", "up", "down"} {
+		value := form.Get(name)
+		if value == "" {
+			continue
+		}
+		throughput, err := parseThroughput(value)
+		if err != nil {
+			return Change{}, err
+		}
+		if throughput <= 0 {
+			return Change{}, fmt.Errorf("%s must be at least 1 byte per second", name)
+		}
+		if name != "down" {
+			change.Up = &throughput
+		}
+		if name != "up" {
+			change.Down = &throughput
+		}
+	}
+	for name, d := range map[string]**time.Duration{"latency": &change.Latency, "jitter": &change.Jitter} {
+		value := form.Get(name)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return Change{}, fmt.Errorf("%s: %w", name, err)
+		}
+		if duration < 0 {
+			return Change{}, fmt.Errorf("%s must not be negative", name)
+		}
+		*d = &duration
+	}
+	if value := form.Get("paused"); value != "" {
+		paused, err := strconv.ParseBool(value)
+		if err != nil {
+			return Change{}, fmt.Errorf("paused must be true or false")
+		}
+		change.Paused = &paused
+	}
+	return change, nil
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin: %v", err)
+	}
+}
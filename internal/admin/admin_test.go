@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProxy records the changes requested through the API.
+type fakeProxy struct {
+	mu      sync.Mutex
+	changes []Change
+}
+
+func (p *fakeProxy) Conditions() Conditions {
+	return Conditions{Up: 1000, Down: 2000, Latency: "0s", Jitter: "0s"}
+}
+func (p *fakeProxy) Connections() []Connection { return nil }
+func (p *fakeProxy) Config() []byte            { return []byte("listen: :8080\nlatency: 40ms\n") }
+
+func (p *fakeProxy) Change(who string, change Change) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.changes = append(p.changes, change)
+}
+
+// serve serves the API for p and returns its URL.
+func serve(t *testing.T, p Proxy) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go Serve(listener, p, strconv.Atoi)
+	return "http://" + listener.Addr().String()
+}
+
+func TestChange(t *testing.T) {
+	tests := []struct {
+		form   string
+		status int
+		change string // the requested change, formatted by describe
+	}{
+		{"throughput=512", http.StatusOK, "up 512 down 512"},
+		{"up=100&latency=40ms", http.StatusOK, "up 100 latency 40ms"},
+		{"down=100&jitter=5ms&paused=true", http.StatusOK, "down 100 jitter 5ms paused true"},
+		{"", http.StatusOK, ""},
+		{"throughput=0", http.StatusBadRequest, ""},
+		{"throughput=fast", http.StatusBadRequest, ""},
+		{"up=100&latency=-1s", http.StatusBadRequest, ""},
+		{"paused=maybe", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		p := &fakeProxy{}
+		values, _ := url.ParseQuery(test.form)
+		resp, err := http.PostForm(serve(t, p)+"/conditions", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%q: status %d, want %d", test.form, resp.StatusCode, test.status)
+		}
+		if test.status != http.StatusOK {
+			if len(p.changes) > 0 {
+				t.Errorf("%q: changed %s", test.form, describe(p.changes[0]))
+			}
+			continue
+		}
+		if len(p.changes) != 1 || describe(p.changes[0]) != test.change {
+			t.Errorf("%q: changes %v, want %q", test.form, p.changes, test.change)
+		}
+	}
+}
+
+// describe formats the conditions change requests.
+func describe(change Change) string {
+	var parts []string
+	if change.Up != nil {
+		parts = append(parts, fmt.Sprintf("up %d", *change.Up))
+	}
+	if change.Down != nil {
+		parts = append(parts, fmt.Sprintf("down %d", *change.Down))
+	}
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{{"latency", change.Latency}, {"jitter", change.Jitter}} {
+		if d.value != nil {
+			parts = append(parts, fmt.Sprintf("%s %v", d.name, *d.value))
+		}
+	}
+	if change.Paused != nil {
+		parts = append(parts, fmt.Sprintf("paused %t", *change.Paused))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestRead(t *testing.T) {
+	base := serve(t, &fakeProxy{})
+	get := func(path string) string {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	var conditions Conditions
+	if err := json.Unmarshal([]byte(get("/conditions")), &conditions); err != nil || conditions.Down != 2000 {
+		t.Errorf("conditions %+v: %v", conditions, err)
+	}
+	// an empty list rather than null, for clients iterating over it
+	if conns := get("/connections"); strings.TrimSpace(conns) != "[]" {
+		t.Errorf("connections %q", conns)
+	}
+	if config := get("/config"); config != "listen: :8080\nlatency: 40ms\n" {
+		t.Errorf("config %q", config)
+	}
+
+	resp, err := http.Post(base+"/config", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET" {
+		t.Errorf("POST /config: status %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
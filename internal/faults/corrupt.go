@@ -0,0 +1,89 @@
+// Package faults injects protocol errors into streams.
+package faults
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+// LineCorrupter injects protocol errors into newline delimited streams to test the robustness of parsers: it inserts
+// garbage lines before lines with probability Garble and cuts lines short with probability Truncate.
+type LineCorrupter struct {
+	Garble, Truncate float64
+
+	atStart  bool // the next byte starts a new line
+	cut      bool // the current line is cut short in its next segment
+	dropping bool // the rest of the current line is dropped
+}
+
+func NewLineCorrupter(garble, truncate float64) *LineCorrupter {
+	return &LineCorrupter{Garble: garble, Truncate: truncate, atStart: true}
+}
+
+// Write writes data with write after corrupting it. Dropped bytes count as written.
+func (c *LineCorrupter) Write(data []byte, write func([]byte) (int, error)) (int, error) {
+	total := len(data)
+	for len(data) > 0 {
+		if c.atStart {
+			c.atStart = false
+			if rand.Float64() < c.Garble {
+				if _, err := write(garbageLine()); err != nil {
+					return total - len(data), err
+				}
+			}
+			c.cut = rand.Float64() < c.Truncate
+		}
+
+		// the segment of the current line in data, without the line break
+		end := bytes.IndexByte(data, '\n')
+		line := data
+		if end >= 0 {
+			line = data[:end]
+		}
+
+		out := line
+		if c.dropping {
+			out = line[:0]
+		}
+		if c.cut {
+			out = line[:rand.Intn(len(line)+1)]
+			c.cut = false
+			c.dropping = true
+		}
+
+		if end >= 0 {
+			if len(out) == len(line) {
+				out = data[:end+1] // the line is complete, write it with its line break at once
+			} else {
+				if len(out) > 0 {
+					if _, err := write(out); err != nil {
+						return total - len(data), err
+					}
+				}
+				out = data[end : end+1]
+			}
+			c.atStart = true
+			c.dropping = false
+		}
+		if len(out) > 0 {
+			if _, err := write(out); err != nil {
+				return total - len(data), err
+			}
+		}
+
+		data = data[len(line):]
+		if end >= 0 {
+			data = data[1:]
+		}
+	}
+	return total, nil
+}
+
+// garbageLine generates a line of up to 32 random printable characters terminated by CRLF.
+func garbageLine() []byte {
+	line := make([]byte, 1+rand.Intn(32), 34)
+	for i := range line {
+		line[i] = byte(' ' + rand.Intn(95))
+	}
+	return append(line, '\r', '\n')
+}
@@ -0,0 +1,76 @@
+package faults
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const input = "first line\nsecond\n\nthird line, written in pieces\n"
+
+// corrupt writes input through c in pieces of size bytes and returns what was written.
+func corrupt(t *testing.T, c *LineCorrupter, size int) string {
+	t.Helper()
+	var out bytes.Buffer
+	for data := []byte(input); len(data) > 0; {
+		piece := data[:min(size, len(data))]
+		if n, err := c.Write(piece, out.Write); n != len(piece) || err != nil {
+			t.Fatalf("wrote %d bytes, %v, want %d", n, err, len(piece))
+		}
+		data = data[len(piece):]
+	}
+	return out.String()
+}
+
+func TestLineCorrupterUnchanged(t *testing.T) {
+	for _, size := range []int{1, 3, 7, len(input)} {
+		if got := corrupt(t, NewLineCorrupter(0, 0), size); got != input {
+			t.Errorf("pieces of %d bytes: wrote %q, want the input unchanged", size, got)
+		}
+	}
+}
+
+func TestLineCorrupterGarble(t *testing.T) {
+	for _, size := range []int{1, 5, len(input)} {
+		lines := strings.SplitAfter(corrupt(t, NewLineCorrupter(1, 0), size), "\n")
+		lines = lines[:len(lines)-1] // after the last line break
+		want := strings.SplitAfter(input, "\n")
+		if len(lines) != 2*(len(want)-1) {
+			t.Fatalf("pieces of %d bytes: %d lines, want a garbage line before each of the %d", size, len(lines),
+				len(want)-1)
+		}
+		for i := 0; i < len(lines); i += 2 {
+			if !strings.HasSuffix(lines[i], "\r\n") || len(lines[i]) < 3 || len(lines[i]) > 34 {
+				t.Errorf("pieces of %d bytes: %q is not a garbage line", size, lines[i])
+			}
+			if lines[i+1] != want[i/2] {
+				t.Errorf("pieces of %d bytes: line %q, want %q", size, lines[i+1], want[i/2])
+			}
+		}
+	}
+}
+
+func TestLineCorrupterTruncate(t *testing.T) {
+	for _, size := range []int{1, 5, len(input)} {
+		got := strings.Split(corrupt(t, NewLineCorrupter(0, 1), size), "\n")
+		want := strings.Split(input, "\n")
+		if len(got) != len(want) {
+			t.Fatalf("pieces of %d bytes: %d lines, want %d, as truncating keeps the line breaks", size, len(got),
+				len(want))
+		}
+		for i := range got {
+			if !strings.HasPrefix(want[i], got[i]) {
+				t.Errorf("pieces of %d bytes: line %q, want a prefix of %q", size, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestLineCorrupterError(t *testing.T) {
+	broken := errors.New("broken")
+	n, err := NewLineCorrupter(0, 0).Write([]byte("a\nb\n"), func([]byte) (int, error) { return 0, broken })
+	if n != 0 || err != broken {
+		t.Errorf("wrote %d bytes, %v, want 0 and the error", n, err)
+	}
+}
@@ -0,0 +1,72 @@
+package pacer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxSkew is how far the wall clock may move apart from the monotonic clock between two readings before it counts as
+// a jump, eg. from an NTP step or from suspending a laptop or VM, during which the wall clock moves on while the
+// monotonic clock stands still on Linux.
+const MaxSkew = time.Second
+
+// clockInterval is how often the watch of the process reads the clocks, which bounds how long the pacers take to
+// notice a jump.
+const clockInterval = 100 * time.Millisecond
+
+// clockWatch detects jumps of the wall clock by comparing consecutive readings of both clocks.
+type clockWatch struct {
+	read  func() (wall time.Time, mono time.Duration) // reads both clocks at once
+	last  time.Time                                   // the previous reading of the wall clock
+	since time.Duration                               // the previous reading of the monotonic clock
+	jumps uint64                                      // accessed atomically
+}
+
+// check reads the clocks and counts a jump if they moved apart by more than MaxSkew since the previous reading. It
+// must not be called concurrently.
+func (w *clockWatch) check() {
+	wall, mono := w.read()
+	if !w.last.IsZero() {
+		skew := wall.Sub(w.last) - (mono - w.since)
+		if skew > MaxSkew || skew < -MaxSkew {
+			atomic.AddUint64(&w.jumps, 1)
+		}
+	}
+	w.last, w.since = wall, mono
+}
+
+// origin is the reference of the monotonic readings of the process's clock.
+var origin = time.Now()
+
+// clock is the watch of the process, read every clockInterval on its own goroutine once a pacer first needs it, so
+// the pacers only load its count instead of sharing the readings.
+var (
+	clock      = clockWatch{read: readClocks}
+	clockStart sync.Once
+)
+
+// readClocks reads the wall clock, without the monotonic reading time.Now adds, and the monotonic clock.
+func readClocks() (time.Time, time.Duration) {
+	now := time.Now()
+	return now.Round(0), now.Sub(origin)
+}
+
+// jumps returns the number of jumps detected so far, starting the watch on the first call. Pacers restart their
+// schedules when it changes, so they neither make up for the time of a jump with a burst nor wait for it to pass.
+func jumps() uint64 {
+	clockStart.Do(func() {
+		clock.check()
+		go func() {
+			for range time.Tick(clockInterval) {
+				clock.check()
+			}
+		}()
+	})
+	return atomic.LoadUint64(&clock.jumps)
+}
+
+// ClockJumps returns the number of jumps of the wall clock the pacers have detected.
+func ClockJumps() uint64 {
+	return atomic.LoadUint64(&clock.jumps)
+}
@@ -0,0 +1,55 @@
+package pacer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClockWatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		wall, mono time.Duration // how far each clock moved between two readings
+		jumps      uint64
+	}{
+		{"steady", time.Second, time.Second, 0},
+		{"drift within MaxSkew", 1500 * time.Millisecond, time.Second, 0},
+		{"NTP step ahead", 10 * time.Second, time.Second, 1},
+		{"NTP step back", -5 * time.Second, time.Second, 1},
+		{"suspended", time.Hour, 0, 1},
+	}
+	for _, test := range tests {
+		start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		readings := []struct {
+			wall time.Time
+			mono time.Duration
+		}{{start, time.Minute}, {start.Add(test.wall), time.Minute + test.mono}}
+		w := clockWatch{read: func() (time.Time, time.Duration) {
+			reading := readings[0]
+			readings = readings[1:]
+			return reading.wall, reading.mono
+		}}
+		w.check()
+		w.check()
+		if w.jumps != test.jumps {
+			t.Errorf("%s: %d jumps, want %d", test.name, w.jumps, test.jumps)
+		}
+	}
+}
+
+func TestPacerRestartsAfterJump(t *testing.T) {
+	// a schedule far ahead, as if the wall clock had been stepped back before the pacer's last reading
+	p := Pacer{next: time.Now().Add(time.Hour), jumps: jumps()}
+	atomic.AddUint64(&clock.jumps, 1)
+
+	done := make(chan time.Duration, 1)
+	go func() { done <- p.Delay(1_000_000, 1000, time.Now()) }()
+	select {
+	case slept := <-done:
+		if slept > 10*time.Millisecond {
+			t.Errorf("slept %v after the jump, want about 1ms for 1000 bytes at 1MB/s", slept)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kept the schedule from before the jump")
+	}
+}
@@ -0,0 +1,52 @@
+package pacer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// paretoShape is the shape of the Pareto distribution of the jitter. With 2 the additional delays average the jitter
+// but have an infinite variance, ie. rare delays are many times longer.
+const paretoShape = 2
+
+// CheckJitterDist validates the name of a jitter distribution for Jitter.
+func CheckJitterDist(dist string) error {
+	switch dist {
+	case "uniform", "normal", "pareto":
+		return nil
+	default:
+		return fmt.Errorf("unknown jitter distribution %s", dist)
+	}
+}
+
+// Jitter returns a random deviation from the latency following the distribution dist with the scale scale:
+//
+//	uniform  evenly distributed between -scale and +scale
+//	normal   normally distributed with a standard deviation of scale
+//	pareto   only additional delays, averaging scale but with a long tail
+//
+// It panics for distributions rejected by CheckJitterDist.
+func Jitter(dist string, scale time.Duration) time.Duration {
+	switch dist {
+	case "uniform":
+		return time.Duration((2*rand.Float64() - 1) * float64(scale))
+	case "normal":
+		return time.Duration(rand.NormFloat64() * float64(scale))
+	case "pareto":
+		// inverse transform sampling, shifted to start at 0
+		u := 1 - rand.Float64() // in (0, 1]
+		return time.Duration((math.Pow(u, -1.0/paretoShape) - 1) * (paretoShape - 1) * float64(scale))
+	default:
+		panic("unknown jitter distribution " + dist)
+	}
+}
+
+// Jittered returns latency varied by Jitter with the scale scale, but never less than 0.
+func Jittered(dist string, latency, scale time.Duration) time.Duration {
+	if scale == 0 {
+		return latency
+	}
+	return max(latency+Jitter(dist, scale), 0)
+}
@@ -0,0 +1,140 @@
+package pacer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// framer splits a byte stream into application-layer messages. It is stateful since messages may span several reads.
+type framer interface {
+	// atStart reports whether the next byte starts a new message.
+	atStart() bool
+	// boundary consumes p up to the end of the current message and returns the number of bytes that complete it, or
+	// -1 if p ends before the message does.
+	boundary(p []byte) int
+}
+
+// CheckFraming validates the name of a framing for NewMessagePacer: line for newline terminated messages, len16 or
+// len32 for messages prefixed by their length as a big-endian integer of 16 or 32 bits.
+func CheckFraming(framing string) error {
+	_, err := newFramer(framing)
+	return err
+}
+
+// newFramer creates the framer for the framing named by framing, see CheckFraming.
+func newFramer(framing string) (framer, error) {
+	switch framing {
+	case "line":
+		return &lineFramer{start: true}, nil
+	case "len16":
+		return &lengthFramer{headerSize: 2}, nil
+	case "len32":
+		return &lengthFramer{headerSize: 4}, nil
+	default:
+		return nil, fmt.Errorf("unknown framing %s", framing)
+	}
+}
+
+// lineFramer frames newline terminated messages.
+type lineFramer struct {
+	start bool
+}
+
+func (f *lineFramer) atStart() bool {
+	return f.start
+}
+
+func (f *lineFramer) boundary(p []byte) int {
+	i := bytes.IndexByte(p, '\n')
+	f.start = i >= 0
+	if i < 0 {
+		return -1
+	}
+	return i + 1
+}
+
+// lengthFramer frames messages prefixed by the length of the message body.
+type lengthFramer struct {
+	headerSize int
+	header     []byte // the part of the current header read so far
+	remaining  int    // bytes of the current body still to come
+}
+
+func (f *lengthFramer) atStart() bool {
+	return len(f.header) == 0 && f.remaining == 0
+}
+
+func (f *lengthFramer) boundary(p []byte) int {
+	n := 0
+	for n < len(p) {
+		if f.remaining > 0 {
+			consumed := min(f.remaining, len(p)-n)
+			f.remaining -= consumed
+			n += consumed
+			if f.remaining == 0 {
+				return n
+			}
+			continue
+		}
+
+		f.header = append(f.header, p[n])
+		n++
+		if len(f.header) < f.headerSize {
+			continue
+		}
+		if f.headerSize == 2 {
+			f.remaining = int(binary.BigEndian.Uint16(f.header))
+		} else {
+			f.remaining = int(binary.BigEndian.Uint32(f.header))
+		}
+		f.header = f.header[:0]
+		if f.remaining == 0 {
+			return n
+		}
+	}
+	return -1
+}
+
+// MessagePacer limits the rate of messages in a stream, eg. one direction of a connection.
+type MessagePacer struct {
+	framer   framer
+	interval time.Duration // minimum time between the starts of two messages
+	next     time.Time     // earliest start of the next message
+}
+
+// NewMessagePacer creates a MessagePacer for rate messages per second delimited according to framing, see CheckFraming.
+func NewMessagePacer(framing string, rate float64) (*MessagePacer, error) {
+	f, err := newFramer(framing)
+	if err != nil {
+		return nil, err
+	}
+	return &MessagePacer{framer: f, interval: time.Duration(float64(time.Second) / rate)}, nil
+}
+
+// Write writes data, split into messages, with write. Before the start of each message it waits until the message
+// rate permits it. It returns the number of bytes written and the first error.
+func (m *MessagePacer) Write(data []byte, write func([]byte) (int, error)) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if m.framer.atStart() {
+			if wait := time.Until(m.next); wait > 0 {
+				time.Sleep(wait)
+			}
+			m.next = time.Now().Add(m.interval)
+		}
+
+		n := m.framer.boundary(data)
+		if n < 0 {
+			n = len(data)
+		}
+		w, err := write(data[:n])
+		written += w
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
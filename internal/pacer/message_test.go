@@ -0,0 +1,102 @@
+package pacer
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writes records the writes of a MessagePacer with the time since start of each.
+type writes struct {
+	start  time.Time
+	chunks []string
+	at     []time.Duration
+}
+
+func (w *writes) write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	w.at = append(w.at, time.Since(w.start))
+	return len(p), nil
+}
+
+func TestMessagePacerLines(t *testing.T) {
+	m, err := NewMessagePacer("line", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &writes{start: time.Now()}
+	// the first message spans two writes, which must not be delayed in between
+	for _, data := range []string{"he", "llo\nwor", "ld\n!\n"} {
+		if n, err := m.Write([]byte(data), w.write); n != len(data) || err != nil {
+			t.Fatalf("wrote %d bytes, %v, want %d", n, err, len(data))
+		}
+	}
+	if want := []string{"he", "llo\n", "wor", "ld\n", "!\n"}; !reflect.DeepEqual(w.chunks, want) {
+		t.Errorf("writes %q, want %q", w.chunks, want)
+	}
+	// messages start 20ms apart at 50 per second
+	for i, message := range []int{0, 0, 1, 1, 2} {
+		want := time.Duration(message) * 20 * time.Millisecond
+		if w.at[i] < want-2*time.Millisecond || w.at[i] > want+20*time.Millisecond {
+			t.Errorf("write %d after %v, want about %v", i, w.at[i], want)
+		}
+	}
+}
+
+func TestMessagePacerLength(t *testing.T) {
+	for _, test := range []struct {
+		framing string
+		size    int
+	}{{"len16", 2}, {"len32", 4}} {
+		m, err := NewMessagePacer(test.framing, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a message with a body of 3 bytes, an empty one, and the header of a third split across writes
+		var data []byte
+		for _, body := range []string{"abc", ""} {
+			header := make([]byte, 4)
+			binary.BigEndian.PutUint32(header, uint32(len(body)))
+			data = append(append(data, header[4-test.size:]...), body...)
+		}
+		w := &writes{start: time.Now()}
+		if _, err := m.Write(append(data, 0), w.write); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{string(data[:test.size+3]), string(data[test.size+3:]), "\x00"}
+		if !reflect.DeepEqual(w.chunks, want) {
+			t.Errorf("%s: writes %q, want %q", test.framing, w.chunks, want)
+		}
+	}
+}
+
+func TestMessagePacerError(t *testing.T) {
+	m, err := NewMessagePacer("line", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := errors.New("broken")
+	calls := 0
+	n, err := m.Write([]byte("a\nb\n"), func(p []byte) (int, error) {
+		if calls++; calls == 2 {
+			return 1, broken
+		}
+		return len(p), nil
+	})
+	if n != 3 || err != broken {
+		t.Errorf("wrote %d bytes, %v, want 3 and the error of the second message", n, err)
+	}
+}
+
+func TestCheckFraming(t *testing.T) {
+	for _, framing := range []string{"line", "len16", "len32"} {
+		if err := CheckFraming(framing); err != nil {
+			t.Errorf("%s: %v", framing, err)
+		}
+	}
+	if err := CheckFraming("len8"); err == nil {
+		t.Error("len8: accepted, want an error")
+	}
+}
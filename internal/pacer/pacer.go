@@ -0,0 +1,74 @@
+// Package pacer delays transfers so they do not exceed a throughput, delays individual chunks by a latency with
+// jitter, and limits the rate of application-layer messages.
+package pacer
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxLag is how far a transmission may start behind the pacing schedule before the schedule is restarted from it.
+// Within this lag the pacer catches up, which corrects for sleeping and scheduling overhead; beyond it the connection
+// was simply idle, which must not be turned into a burst.
+const MaxLag = 50 * time.Millisecond
+
+// Pacer sleeps for the appropriate amount of time in order to simulate throughput. Instead of pausing for each chunk
+// in isolation, it keeps a schedule of when the data transmitted so far should have been finished, so rounding and
+// overhead do not accumulate into drift over long transfers. The zero value is ready to use.
+type Pacer struct {
+	next  time.Time // when the data transmitted so far is due to be finished
+	jumps uint64    // clock jumps seen when the schedule was last checked, see jumps
+}
+
+// Delay requires the amount of transmitted data and the time its transmission started in order to calculate the
+// pause time. It returns how long it slept, which is more than 0 if the transmission was faster than the throughput
+// allows.
+func (p *Pacer) Delay(throughput, transmitted int, start time.Time) time.Duration {
+	if jumps := jumps(); start.Sub(p.next) > MaxLag || jumps != p.jumps {
+		p.next, p.jumps = start, jumps
+	}
+
+	// calculate how long the transmission should have taken
+	p.next = p.next.Add(time.Duration(float64(transmitted) / float64(throughput) * float64(time.Second)))
+
+	// Sleep the remaining amount of time if necessary
+	wait := time.Until(p.next)
+	if wait <= 0 {
+		return 0
+	}
+	time.Sleep(wait)
+	return wait
+}
+
+// SharedSlices is the number of chunks per second the transfers sharing a throughput should be split into at most, so
+// they take turns.
+const SharedSlices = 10
+
+// Shared limits the aggregate throughput of several transfers, eg. all connections in one direction. It hands out
+// consecutive time slots for the transfers, so they take turns and the total never exceeds the throughput. The zero
+// value is ready to use.
+type Shared struct {
+	mu    sync.Mutex
+	next  time.Time // when the slots handed out so far end
+	jumps uint64    // clock jumps seen when the slots were last checked, see jumps
+}
+
+// Wait reserves a slot for a transfer of size bytes at throughput and sleeps until it starts. It returns how long it
+// slept.
+func (s *Shared) Wait(throughput, size int) time.Duration {
+	s.mu.Lock()
+	now := time.Now()
+	if jumps := jumps(); now.Sub(s.next) > MaxLag || jumps != s.jumps {
+		s.next, s.jumps = now, jumps
+	}
+	start := s.next
+	s.next = s.next.Add(time.Duration(float64(size) / float64(throughput) * float64(time.Second)))
+	s.mu.Unlock()
+
+	wait := start.Sub(now)
+	if wait <= 0 {
+		return 0
+	}
+	time.Sleep(wait)
+	return wait
+}
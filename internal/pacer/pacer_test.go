@@ -0,0 +1,75 @@
+package pacer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// within reports an error unless elapsed is at least want and, allowing for a loaded machine, less than twice that.
+func within(t *testing.T, what string, elapsed, want time.Duration) {
+	t.Helper()
+	if elapsed < want-5*time.Millisecond || elapsed > 2*want {
+		t.Errorf("%s took %v, want about %v", what, elapsed, want)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	var p Pacer
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		p.Delay(100_000, 1000, time.Now())
+	}
+	within(t, "10 KB at 100 KB/s", time.Since(start), 100*time.Millisecond)
+}
+
+func TestPacerAfterIdle(t *testing.T) {
+	var p Pacer
+	p.Delay(100_000, 1000, time.Now())
+	time.Sleep(2 * MaxLag)
+
+	// the idle time must not be made up for with a burst
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		p.Delay(100_000, 1000, time.Now())
+	}
+	within(t, "5 KB at 100 KB/s after being idle", time.Since(start), 50*time.Millisecond)
+}
+
+func TestPacerCatchesUp(t *testing.T) {
+	var p Pacer
+	start := time.Now()
+	p.Delay(100_000, 1000, start)
+	// a transmission that started late, within MaxLag, is not delayed as long
+	if slept := p.Delay(100_000, 1000, time.Now().Add(5*time.Millisecond)); slept > 10*time.Millisecond {
+		t.Errorf("slept %v for a late start, want at most the 10ms of the schedule", slept)
+	}
+	within(t, "2 KB at 100 KB/s", time.Since(start), 20*time.Millisecond)
+}
+
+func TestShared(t *testing.T) {
+	var s Shared
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				s.Wait(100_000, 1000)
+			}
+		}()
+	}
+	wg.Wait()
+	// the last of the 20 slots of 10ms starts after 190ms
+	within(t, "4 transfers of 5 KB sharing 100 KB/s", time.Since(start), 190*time.Millisecond)
+}
+
+func TestSharedAfterIdle(t *testing.T) {
+	var s Shared
+	s.Wait(100_000, 1000)
+	time.Sleep(2 * MaxLag)
+	if slept := s.Wait(100_000, 1000); slept != 0 {
+		t.Errorf("slept %v after being idle, want the slot to start at once", slept)
+	}
+}
@@ -0,0 +1,265 @@
+// Package relay copies one direction of a proxied connection under the conditions of a slow network: a throughput,
+// shared with other connections or not, latency, a slow reader, paced messages, protocol errors and a blackhole. The
+// conditions that depend on more than the pipe, eg. runtime changes, quotas or idle connections, are left to the
+// Conditions of the pipe, so the slowproxy command and the library relay data the same way.
+package relay
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/faults"
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// Endpoint is one side of a proxied connection. Like *net.TCPConn, its two directions can be closed independently.
+type Endpoint interface {
+	io.ReadWriteCloser
+	CloseRead() error
+	CloseWrite() error
+}
+
+// Direction is the direction a pipe copies in.
+type Direction int
+
+const (
+	Up   Direction = iota // from the client to the upstream
+	Down                  // from the upstream to the client
+)
+
+// String names the direction: upstream or downstream.
+func (d Direction) String() string {
+	if d == Up {
+		return "upstream"
+	}
+	return "downstream"
+}
+
+// ReadSide and WriteSide name the sides of the connection a pipe in direction d reads from and writes to: client or
+// upstream.
+func (d Direction) ReadSide() string {
+	if d == Up {
+		return "client"
+	}
+	return "upstream"
+}
+
+func (d Direction) WriteSide() string {
+	if d == Up {
+		return "upstream"
+	}
+	return "client"
+}
+
+// Conditions decides the conditions of a pipe that depend on more than the pipe and is told what happens on it. Its
+// methods are called on the pipe's goroutine.
+type Conditions interface {
+	// Throughput returns the throughput for the next chunk in bytes per second, 0 for no limit, or false to end the
+	// connection, eg. once it exceeded a quota. It may block, eg. while transfers are paused.
+	Throughput() (int, bool)
+	// Received is called with each chunk read that is not blackholed, before it is forwarded. It returns false to stop
+	// the pipe without forwarding the chunk, eg. after resetting the connection.
+	Received(chunk []byte) bool
+	// Blackholed is called when a chunk of size bytes stalls the pipe at the blackhole.
+	Blackholed(size int)
+	// Latency returns the delay of the next chunk.
+	Latency() time.Duration
+	// Forwarded is called once a chunk of n bytes has been forwarded at throughput, with the time slept to pace it.
+	Forwarded(n, throughput int, slept time.Duration)
+	// Ended is called once when the pipe stops because side, client or upstream, closed its end of the connection, or
+	// because of err on side. The pipe closes its ends after the call.
+	Ended(side string, err error)
+}
+
+// Pipe copies the data read from R to W. Set the fields, then call Run.
+type Pipe struct {
+	Direction  Direction
+	W, R       Endpoint
+	Conditions Conditions
+
+	Shared      *pacer.Shared         // schedules the transfers of several pipes sharing the throughput, or nil
+	Unthrottled int64                 // bytes at the start forwarded without limiting the throughput
+	CloseDelay  time.Duration         // delay before closing W once R is closed
+	ReadSize    int                   // maximum bytes per read from R, 0 for no limit
+	ReadGap     time.Duration         // pause between reads from R
+	Messages    *pacer.MessagePacer   // limits the message rate, nil for no limit
+	Corrupter   *faults.LineCorrupter // injects protocol errors, nil for none
+	Blackhole   int                   // a chunk larger than this many bytes stalls the pipe, 0 for none
+	Stop        <-chan struct{}       // closed when a stalled pipe stops, eg. once the other direction is done
+
+	// Transform, if not nil, returns the data to forward in place of each chunk read, and is called with a nil chunk
+	// to flush what it held back once R is closed. The throughput applies to the data it returns.
+	Transform func(chunk []byte) ([]byte, error)
+
+	transferred int64 // bytes, accessed atomically
+	throttled   int64 // time spent sleeping to limit the throughput in nanoseconds, accessed atomically
+}
+
+// Transferred returns the bytes forwarded so far.
+func (p *Pipe) Transferred() int64 {
+	return atomic.LoadInt64(&p.transferred)
+}
+
+// Throttled returns the time spent sleeping to limit the throughput so far.
+func (p *Pipe) Throttled() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.throttled))
+}
+
+// Run works like io.Copy but limits the throughput, reading no more than len(buf) bytes or one second worth of data
+// at a time. When R is closed it closes W for writing, and when W stops reading it closes R for reading, so each side
+// sees the close of the other. It returns when the pipe is done, which for a pipe stalled by the blackhole is once Stop
+// is closed.
+func (p *Pipe) Run(buf []byte) {
+	if p.ReadSize > 0 {
+		buf = buf[:min(len(buf), p.ReadSize)]
+	}
+	var pace pacer.Pacer
+	for first := true; ; first = false {
+		if !first && p.ReadGap > 0 {
+			// a slow reader leaves the data in R's buffers, so the peer feels the backpressure
+			time.Sleep(p.ReadGap)
+		}
+		throughput, ok := p.Conditions.Throughput()
+		if !ok {
+			p.W.Close()
+			p.R.Close()
+			return
+		}
+
+		start := time.Now()
+		readSize := len(buf)
+		if throughput > 0 {
+			readSize = min(readSize, throughput)
+			if p.Shared != nil {
+				// small chunks let the pipes sharing the throughput take turns
+				readSize = min(readSize, max(throughput/pacer.SharedSlices, 1))
+			}
+		}
+		size, err := p.R.Read(buf[:readSize])
+		if err == io.EOF || IsBrokenPipe(err) {
+			p.closed()
+			return
+		}
+		if err != nil {
+			p.fail(p.Direction.ReadSide(), err)
+			return
+		}
+
+		if p.Blackhole > 0 && size > p.Blackhole {
+			// like a router dropping the packets beyond the path MTU without telling the sender, which retransmits
+			// them forever while nothing sent after them can be delivered: the chunk and the rest of the stream are
+			// left unread until the pipe has to stop
+			p.Conditions.Blackholed(size)
+			<-p.Stop
+			p.W.Close()
+			p.R.Close()
+			return
+		}
+		if !p.Conditions.Received(buf[:size]) {
+			return
+		}
+		chunk := buf[:size]
+		if p.Transform != nil {
+			if chunk, err = p.Transform(chunk); err != nil {
+				p.fail(p.Direction.ReadSide(), err)
+				return
+			}
+			if len(chunk) == 0 {
+				continue
+			}
+		}
+
+		paced := len(chunk)
+		if before := atomic.LoadInt64(&p.transferred); before < p.Unthrottled {
+			// only the part beyond the unthrottled start of the stream counts
+			paced = max(0, len(chunk)-int(p.Unthrottled-before))
+		}
+		var slept time.Duration
+		if p.Shared != nil && throughput > 0 {
+			slept = p.Shared.Wait(throughput, paced)
+		}
+		if latency := p.Conditions.Latency(); latency > 0 {
+			// the pacer accounts for this time, so it only reduces the throughput when chunks are small
+			time.Sleep(latency)
+		}
+
+		if !p.forward(chunk) {
+			return
+		}
+		if p.Shared == nil && throughput > 0 {
+			slept = pace.Delay(throughput, paced, start)
+		}
+		atomic.AddInt64(&p.throttled, int64(slept))
+		p.Conditions.Forwarded(len(chunk), throughput, slept)
+	}
+}
+
+// forward writes chunk to W and reports whether the pipe goes on. If W stopped reading, R is closed for reading.
+func (p *Pipe) forward(chunk []byte) bool {
+	_, err := p.write(chunk)
+	if err == io.EOF || IsBrokenPipe(err) {
+		p.Conditions.Ended(p.Direction.WriteSide(), nil)
+		p.R.CloseRead()
+		return false
+	}
+	if err != nil {
+		p.fail(p.Direction.WriteSide(), err)
+		return false
+	}
+	atomic.AddInt64(&p.transferred, int64(len(chunk)))
+	return true
+}
+
+// closed passes on the close of R to W, after forwarding what Transform held back.
+func (p *Pipe) closed() {
+	if p.Transform != nil {
+		tail, err := p.Transform(nil)
+		if err != nil {
+			p.fail(p.Direction.ReadSide(), err)
+			return
+		}
+		if len(tail) > 0 && !p.forward(tail) {
+			return
+		}
+	}
+	p.Conditions.Ended(p.Direction.ReadSide(), nil)
+	if p.CloseDelay > 0 {
+		time.Sleep(p.CloseDelay)
+	}
+	p.W.CloseWrite()
+}
+
+// fail ends the pipe after err on side and closes both ends.
+func (p *Pipe) fail(side string, err error) {
+	p.Conditions.Ended(side, err)
+	p.W.Close()
+	p.R.Close()
+}
+
+// write writes data to W, passing it through the line corrupter and the message pacer if configured.
+func (p *Pipe) write(data []byte) (int, error) {
+	write := p.W.Write
+	if p.Messages != nil {
+		write = func(b []byte) (int, error) {
+			return p.Messages.Write(b, p.W.Write)
+		}
+	}
+	if p.Corrupter != nil {
+		return p.Corrupter.Write(data, write)
+	}
+	return write(data)
+}
+
+// IsBrokenPipe determines if err was caused by an EPIPE error. macOS reports EPROTOTYPE instead when the peer goes
+// away while the write is in progress.
+func IsBrokenPipe(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EPIPE || runtime.GOOS == "darwin" && errno == syscall.EPROTOTYPE
+}
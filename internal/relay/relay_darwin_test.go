@@ -0,0 +1,16 @@
+package relay
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsBrokenPipeEPROTOTYPE(t *testing.T) {
+	// macOS reports EPROTOTYPE instead of EPIPE when the peer goes away during a write
+	err := &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPROTOTYPE)}
+	if !IsBrokenPipe(err) {
+		t.Errorf("IsBrokenPipe(%v) = false", err)
+	}
+}
@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fixed are the conditions of a pipe with a constant throughput, which records how the pipe ended.
+type fixed struct {
+	throughput int
+	blackholed int // size of the chunk that stalled the pipe
+	side       string
+	err        error
+}
+
+func (f *fixed) Throughput() (int, bool)           { return f.throughput, true }
+func (f *fixed) Received([]byte) bool              { return true }
+func (f *fixed) Blackholed(size int)               { f.blackholed = size }
+func (f *fixed) Latency() time.Duration            { return 0 }
+func (f *fixed) Forwarded(int, int, time.Duration) {}
+func (f *fixed) Ended(side string, err error)      { f.side, f.err = side, err }
+
+// tcpPair returns the two ends of a TCP connection over the loopback interface.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// relayed sends data from a client through p, configured by setup, to an upstream and returns what the upstream
+// received until the client's close was passed on, and the time it took. It returns once p is done.
+func relayed(t *testing.T, data []byte, setup func(p *Pipe)) ([]byte, time.Duration) {
+	client, proxyClient := tcpPair(t)
+	proxyUpstream, upstream := tcpPair(t)
+	p := &Pipe{Direction: Up, W: proxyUpstream, R: proxyClient}
+	setup(p)
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		p.Run(make([]byte, 32*1024))
+		close(done)
+	}()
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	received, err := io.ReadAll(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	<-done
+	return received, elapsed
+}
+
+func TestRunRate(t *testing.T) {
+	const throughput = 100_000
+	data := make([]byte, throughput/2)
+	conditions := &fixed{throughput: throughput}
+	var p *Pipe
+	received, elapsed := relayed(t, data, func(pipe *Pipe) {
+		p, pipe.Conditions = pipe, conditions
+	})
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, want %d", len(received), len(data))
+	}
+	// about half a second, allowing for scheduling on busy test machines
+	if want := 500 * time.Millisecond; elapsed < want*9/10 || elapsed > want*11/10 {
+		t.Errorf("took %v at %d bytes/s, want about %v", elapsed, throughput, want)
+	}
+	if p.Transferred() != int64(len(data)) {
+		t.Errorf("transferred %d bytes, want %d", p.Transferred(), len(data))
+	}
+	if conditions.side != "client" || conditions.err != nil {
+		t.Errorf("ended by %s: %v, want the client's close", conditions.side, conditions.err)
+	}
+}
+
+func TestRunTransformFlush(t *testing.T) {
+	data := []byte("held back until the client closes")
+	conditions := &fixed{}
+	received, _ := relayed(t, data, func(p *Pipe) {
+		var held []byte
+		p.Conditions = conditions
+		p.Transform = func(chunk []byte) ([]byte, error) {
+			if chunk == nil {
+				return bytes.ToUpper(held), nil
+			}
+			held = append(held, chunk...)
+			return nil, nil
+		}
+	})
+	if want := bytes.ToUpper(data); !bytes.Equal(received, want) {
+		t.Errorf("received %q, want %q", received, want)
+	}
+	if conditions.side != "client" || conditions.err != nil {
+		t.Errorf("ended by %s: %v, want the client's close", conditions.side, conditions.err)
+	}
+}
+
+func TestRunBlackhole(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyUpstream, upstream := tcpPair(t)
+	stop := make(chan struct{})
+	conditions := &fixed{}
+	p := &Pipe{Direction: Up, W: proxyUpstream, R: proxyClient, Conditions: conditions, Blackhole: 100, Stop: stop}
+	done := make(chan struct{})
+	go func() {
+		p.Run(make([]byte, 32*1024))
+		close(done)
+	}()
+
+	small := bytes.Repeat([]byte("s"), 50)
+	client.Write(small)
+	received := make([]byte, len(small))
+	if _, err := io.ReadFull(upstream, received); err != nil || !bytes.Equal(received, small) {
+		t.Fatalf("received %q: %v, want the small chunk", received, err)
+	}
+	// nothing after the large chunk passes either, like with a sender retransmitting it forever
+	client.Write(bytes.Repeat([]byte("l"), 200))
+	time.Sleep(50 * time.Millisecond)
+	client.Write(small)
+	upstream.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := upstream.Read(received); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("received %q after the large chunk: %v", received[:n], err)
+	}
+	select {
+	case <-done:
+		t.Fatal("stopped before Stop was closed")
+	default:
+	}
+
+	close(stop)
+	<-done
+	if conditions.blackholed != 200 {
+		t.Errorf("blackholed %d bytes, want the large chunk of 200", conditions.blackholed)
+	}
+	upstream.SetReadDeadline(time.Time{})
+	if rest, err := io.ReadAll(upstream); len(rest) > 0 || err != nil {
+		t.Errorf("received %q: %v, want the close once stopped", rest, err)
+	}
+}
+
+func TestIsBrokenPipe(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EPIPE, true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{fmt.Errorf("copy: %w", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, false},
+		{errors.New("broken pipe"), false},
+		{net.ErrClosed, false},
+	}
+	for _, test := range tests {
+		if got := IsBrokenPipe(test.err); got != test.want {
+			t.Errorf("IsBrokenPipe(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package slowproxy embeds a throttled TCP proxy in Go programs, eg. in test suites that exercise a client against a
+// slow network in-process instead of running the slowproxy command. ThrottledConn slows down a single connection
+// without a proxy in between.
+package slowproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/relay"
+)
+
+// Proxy forwards the connections accepted on Listen to Forward, limiting the throughput and adding latency in each
+// direction. Set the fields, then call Start; they must not be changed while the proxy runs.
+type Proxy struct {
+	Listen  string // address to listen on, 127.0.0.1:0 for any free port if empty
+	Forward string // address to forward to
+
+	// UpThroughput and DownThroughput are the maximum throughput towards Forward and towards the client in bytes per
+	// second, 0 for no limit.
+	UpThroughput, DownThroughput int
+	Latency                      time.Duration // delay of each chunk in each direction
+
+	// newTransformers create the transformers of each connection by direction, see AddTransformer
+	newTransformers [2][]func() Transformer
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{} // open connections on either side, nil once stopped
+	wg       sync.WaitGroup        // accepting and handling connections
+}
+
+// New returns a proxy forwarding to forward with the same throughput in bytes per second in each direction, listening
+// on any free port of the loopback interface once started.
+func New(forward string, throughput int) *Proxy {
+	return &Proxy{Forward: forward, UpThroughput: throughput, DownThroughput: throughput}
+}
+
+// Direction is the direction data is forwarded in.
+type Direction int
+
+const (
+	Up   Direction = iota // from the client to Forward
+	Down                  // from Forward to the client
+)
+
+// Transformer inspects and modifies the data forwarded in one direction of a connection, eg. to redact tokens or
+// translate a protocol. The throughput and latency apply to the data it returns.
+type Transformer interface {
+	// Transform returns the data to forward in place of chunk, which may be chunk itself modified in place or
+	// nothing. Once the sending side closes, it is called with a nil chunk to return the data it held back, if any,
+	// eg. a token split across chunks. An error closes the connection.
+	Transform(chunk []byte) ([]byte, error)
+}
+
+// TransformerFunc adapts a function keeping no state between chunks to a Transformer.
+type TransformerFunc func(chunk []byte) ([]byte, error)
+
+func (f TransformerFunc) Transform(chunk []byte) ([]byte, error) {
+	return f(chunk)
+}
+
+// AddTransformer registers newTransformer to create a Transformer for each connection in direction, so transformers
+// can keep state for their connection. Transformers apply in the order they were added. It must be called before
+// Start.
+func (p *Proxy) AddTransformer(direction Direction, newTransformer func() Transformer) {
+	p.newTransformers[direction] = append(p.newTransformers[direction], newTransformer)
+}
+
+// transformers creates the transformers of a new connection in direction.
+func (p *Proxy) transformers(direction Direction) []Transformer {
+	transformers := make([]Transformer, len(p.newTransformers[direction]))
+	for i, newTransformer := range p.newTransformers[direction] {
+		transformers[i] = newTransformer()
+	}
+	return transformers
+}
+
+// transform passes chunk through transformers in turn. A nil chunk flushes them: each gets the data flushed by the
+// previous ones, then a nil chunk of its own.
+func transform(transformers []Transformer, chunk []byte) ([]byte, error) {
+	flush := chunk == nil
+	for _, t := range transformers {
+		var err error
+		var out []byte
+		if len(chunk) > 0 {
+			if out, err = t.Transform(chunk); err != nil {
+				return nil, err
+			}
+		}
+		if flush {
+			tail, err := t.Transform(nil)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, tail...)
+		}
+		chunk = out
+	}
+	return chunk, nil
+}
+
+// Start listens on Listen and starts forwarding the connections in the background.
+func (p *Proxy) Start() error {
+	listen := p.Listen
+	if listen == "" {
+		listen = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.listener, p.conns = listener, map[net.Conn]struct{}{}
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// eg. out of file descriptors, which open connections may free up
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.handle(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the proxy listens on, eg. to connect clients to when listening on port 0. It returns nil
+// before Start.
+func (p *Proxy) Addr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// Stop stops listening, closes all connections and returns once they have been handled.
+func (p *Proxy) Stop() error {
+	p.mu.Lock()
+	if p.listener == nil {
+		p.mu.Unlock()
+		return errors.New("slowproxy: not started")
+	}
+	err := p.listener.Close()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+// track registers conn to be closed by Stop. It returns false if the proxy has been stopped already.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+// handle dials Forward for the client connection conn and copies data in both directions until both sides are closed.
+func (p *Proxy) handle(client net.Conn) {
+	defer client.Close()
+	if !p.track(client) {
+		return
+	}
+	defer p.untrack(client)
+	upstream, err := net.Dial("tcp", p.Forward)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	if !p.track(upstream) {
+		return
+	}
+	defer p.untrack(upstream)
+
+	done := make(chan struct{})
+	go func() {
+		p.pipe(relay.Up, upstream, client, p.UpThroughput).Run(make([]byte, 32*1024))
+		close(done)
+	}()
+	p.pipe(relay.Down, client, upstream, p.DownThroughput).Run(make([]byte, 32*1024))
+	<-done
+}
+
+// pipe returns the relay copying from r to w in direction at throughput through the transformers of a new connection,
+// which passes on the close of r to w like the slowproxy command.
+func (p *Proxy) pipe(direction relay.Direction, w, r net.Conn, throughput int) *relay.Pipe {
+	pipe := &relay.Pipe{Direction: direction, W: endpoint(w), R: endpoint(r),
+		Conditions: conditions{throughput: throughput, latency: p.Latency}}
+	// Up and Down have the values of relay.Up and relay.Down
+	if transformers := p.transformers(Direction(direction)); len(transformers) > 0 {
+		pipe.Transform = func(chunk []byte) ([]byte, error) {
+			return transform(transformers, chunk)
+		}
+	}
+	return pipe
+}
+
+// conditions are the fixed conditions of a pipe of the proxy.
+type conditions struct {
+	throughput int
+	latency    time.Duration
+}
+
+func (c conditions) Throughput() (int, bool)           { return c.throughput, true }
+func (c conditions) Received([]byte) bool              { return true }
+func (c conditions) Blackholed(int)                    {}
+func (c conditions) Latency() time.Duration            { return c.latency }
+func (c conditions) Forwarded(int, int, time.Duration) {}
+func (c conditions) Ended(string, error)               {}
+
+// halfCloser adapts a connection that cannot close its directions independently to relay.Endpoint by closing it
+// entirely for either.
+type halfCloser struct {
+	net.Conn
+}
+
+func (c halfCloser) CloseRead() error  { return c.Close() }
+func (c halfCloser) CloseWrite() error { return c.Close() }
+
+// endpoint returns conn as a relay.Endpoint.
+func endpoint(conn net.Conn) relay.Endpoint {
+	if e, ok := conn.(relay.Endpoint); ok {
+		return e
+	}
+	return halfCloser{conn}
+}
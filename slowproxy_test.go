@@ -0,0 +1,69 @@
+package slowproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve accepts a single connection on a new listener, which reads what the client sends until it closes and replies
+// with response, and returns the listener's address and what it read.
+func serve(t *testing.T, response []byte) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	request := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		request <- data
+		conn.Write(response)
+	}()
+	return listener.Addr().String(), request
+}
+
+func TestProxy(t *testing.T) {
+	const throughput = 100_000
+	response := bytes.Repeat([]byte("slow "), throughput/2/5)
+	forward, request := serve(t, response)
+	p := New(forward, throughput)
+	p.AddTransformer(Down, func() Transformer {
+		return TransformerFunc(func(chunk []byte) ([]byte, error) {
+			return bytes.ToUpper(chunk), nil
+		})
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("request"))
+	// the upstream replies once the close is passed on
+	conn.(*net.TCPConn).CloseWrite()
+	start := time.Now()
+	received, err := io.ReadAll(conn)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-request; string(got) != "request" {
+		t.Errorf("upstream received %q", got)
+	}
+	if want := bytes.ToUpper(response); !bytes.Equal(received, want) {
+		t.Fatalf("received %d bytes, want %d transformed bytes", len(received), len(want))
+	}
+	checkRate(t, throughput, len(received), elapsed)
+}
@@ -0,0 +1,84 @@
+package slowproxy
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dmiruke/slowproxy/internal/pacer"
+)
+
+// Rate is a throughput in bytes per second, eg. 512 * slowproxy.KBps or 10 * slowproxy.Mbps. A rate of 0 does not
+// limit the throughput.
+type Rate int
+
+const (
+	BytesPerSecond Rate = 1
+	KBps                = 1000 * BytesPerSecond
+	MBps                = 1000 * KBps
+	Kbps                = KBps / 8
+	Mbps                = MBps / 8
+	Gbps                = 1000 * Mbps
+)
+
+// NewReader returns a reader that reads from r at most at rate, eg. to pace reading a file or an HTTP body. Each
+// Read returns at most one second worth of data once the rate allows for it.
+func NewReader(r io.Reader, rate Rate) io.Reader {
+	return &reader{r: r, rate: max(int(rate), 0)}
+}
+
+// NewWriter returns a writer that writes to w at most at rate. Each Write passes the data on in chunks of at most one
+// second worth of data and returns once the rate allows for the last one.
+func NewWriter(w io.Writer, rate Rate) io.Writer {
+	return &writer{w: w, rate: max(int(rate), 0)}
+}
+
+type reader struct {
+	r    io.Reader
+	rate int
+
+	mu   sync.Mutex // one Read at a time keeps to the schedule of the pacer
+	pace pacer.Pacer
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.rate == 0 {
+		return r.r.Read(p)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := time.Now()
+	n, err := r.r.Read(p[:min(len(p), r.rate)])
+	if n > 0 {
+		r.pace.Delay(r.rate, n, start)
+	}
+	return n, err
+}
+
+type writer struct {
+	w    io.Writer
+	rate int
+
+	mu   sync.Mutex // one Write at a time keeps to the schedule of the pacer
+	pace pacer.Pacer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.rate == 0 {
+		return w.w.Write(p)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		start := time.Now()
+		n, err := w.w.Write(p[:min(len(p), w.rate)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		w.pace.Delay(w.rate, n, start)
+		p = p[n:]
+	}
+	return written, nil
+}
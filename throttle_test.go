@@ -0,0 +1,152 @@
+package slowproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tolerance is how far the achieved rate may deviate from the requested one in the tests, to allow for scheduling
+// on busy test machines.
+const tolerance = 0.1
+
+// paceTests transfer about half a second worth of data each, in chunks smaller and larger than one second worth.
+var paceTests = []struct {
+	name  string
+	rate  Rate
+	size  int
+	chunk int
+}{
+	{"small chunks", 200 * KBps, 100_000, 1000},
+	{"large chunks", 2 * Mbps, 125_000, 64 * 1024},
+	{"chunks above the rate", 100 * KBps, 50_000, 1 << 20},
+}
+
+// checkRate fails t unless size bytes transferred in elapsed achieve rate within tolerance.
+func checkRate(t *testing.T, rate Rate, size int, elapsed time.Duration) {
+	t.Helper()
+	achieved := float64(size) / elapsed.Seconds()
+	if achieved > float64(rate)*(1+tolerance) || achieved < float64(rate)*(1-tolerance) {
+		t.Errorf("achieved %.0f bytes/s in %v, want %d bytes/s within %.0f%%", achieved, elapsed, rate, 100*tolerance)
+	}
+}
+
+func TestReaderRate(t *testing.T) {
+	for _, test := range paceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			data := make([]byte, test.size)
+			r := NewReader(bytes.NewReader(data), test.rate)
+			buf := make([]byte, test.chunk)
+			start := time.Now()
+			read := 0
+			for {
+				n, err := r.Read(buf)
+				read += n
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			elapsed := time.Since(start)
+			if read != test.size {
+				t.Fatalf("read %d bytes, want %d", read, test.size)
+			}
+			checkRate(t, test.rate, read, elapsed)
+		})
+	}
+}
+
+func TestWriterRate(t *testing.T) {
+	for _, test := range paceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var out bytes.Buffer
+			w := NewWriter(&out, test.rate)
+			data := make([]byte, test.size)
+			start := time.Now()
+			for p := data; len(p) > 0; {
+				n, err := w.Write(p[:min(len(p), test.chunk)])
+				if err != nil {
+					t.Fatal(err)
+				}
+				p = p[n:]
+			}
+			elapsed := time.Since(start)
+			if out.Len() != test.size {
+				t.Fatalf("wrote %d bytes, want %d", out.Len(), test.size)
+			}
+			checkRate(t, test.rate, out.Len(), elapsed)
+		})
+	}
+}
+
+func TestUnlimitedRate(t *testing.T) {
+	data := make([]byte, 100*int(MBps))
+	start := time.Now()
+	if n, err := io.Copy(io.Discard, NewReader(bytes.NewReader(data), 0)); err != nil || n != int64(len(data)) {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	if n, err := NewWriter(io.Discard, 0).Write(data); err != nil || n != len(data) {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	// far faster than any rate, even on slow machines
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v for %d bytes", elapsed, 2*len(data))
+	}
+}
+
+func TestThrottledConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	const rate, size = 100 * KBps, 50_000
+	conn := NewThrottledConn(dialed, int(rate))
+	defer conn.Close()
+
+	// writing, then closing the writing side so the other end sees all of it and the end
+	received := make(chan int, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, accepted)
+		received <- int(n)
+	}()
+	start := time.Now()
+	if n, err := conn.Write(make([]byte, size)); err != nil || n != size {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-received; n != size {
+		t.Fatalf("received %d bytes, want %d", n, size)
+	}
+	checkRate(t, rate, size, time.Since(start))
+
+	// reading
+	go func() {
+		accepted.Write(make([]byte, size))
+		accepted.Close()
+	}()
+	start = time.Now()
+	if n, err := io.Copy(io.Discard, conn); err != nil || n != size {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	checkRate(t, rate, size, time.Since(start))
+}